@@ -3,10 +3,17 @@ module github.com/storagebit/lure
 go 1.18
 
 require (
-	github.com/buger/goterm v1.0.4 // indirect
+	github.com/buger/goterm v1.0.4
+	github.com/dustin/go-humanize v1.0.0
+	github.com/influxdata/influxdb-client-go v1.4.0
+	golang.org/x/crypto v0.0.0-20191112222119-e1110fd1c708
+	golang.org/x/net v0.0.0-20191112182307-2180aed22343
+	golang.org/x/sys v0.0.0-20210331175145-43e1dd70ce54
+	gopkg.in/yaml.v2 v2.2.5
+)
+
+require (
 	github.com/deepmap/oapi-codegen v1.3.6 // indirect
-	github.com/dustin/go-humanize v1.0.0 // indirect
-	github.com/influxdata/influxdb-client-go v1.4.0 // indirect
 	github.com/influxdata/influxdb1-client v0.0.0-20220302092344-a9ab5670611c // indirect
 	github.com/influxdata/line-protocol v0.0.0-20200327222509-2487e7298839 // indirect
 	github.com/labstack/echo/v4 v4.1.11 // indirect
@@ -16,9 +23,5 @@ require (
 	github.com/pkg/errors v0.9.1 // indirect
 	github.com/valyala/bytebufferpool v1.0.0 // indirect
 	github.com/valyala/fasttemplate v1.1.0 // indirect
-	golang.org/x/crypto v0.0.0-20191112222119-e1110fd1c708 // indirect
-	golang.org/x/net v0.0.0-20191112182307-2180aed22343 // indirect
-	golang.org/x/sys v0.0.0-20210331175145-43e1dd70ce54 // indirect
 	golang.org/x/text v0.3.2 // indirect
-	gopkg.in/yaml.v2 v2.2.5 // indirect
 )
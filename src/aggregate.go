@@ -0,0 +1,437 @@
+/*
+MIT License
+
+Copyright (c) 2020 storagebit.ch
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	tm "github.com/buger/goterm"
+)
+
+var (
+	aggregating bool
+	agents      aggregator
+)
+
+// aggregator scrapes the /api/v1/ of many lure agents and merges their stats into one sample. Devices are
+// named "server/device" in the merged sample.
+type aggregator struct {
+	sync.Mutex
+	list    []string
+	file    string
+	token   string
+	timeout time.Duration
+	client  *http.Client
+	agents  map[string]*agent
+}
+
+// agent is the state of one scraped lure instance, as shown by /api/v1/agents.
+type agent struct {
+	URL      string     `json:"url"`
+	Host     string     `json:"host"`
+	Up       bool       `json:"up"`
+	LastSeen *time.Time `json:"last_seen,omitempty"`
+	Error    string     `json:"error,omitempty"`
+	Failures int        `json:"failures"`
+
+	sample statsSample
+}
+
+// agentURLs returns the agents from -agents and the -agentsfile, the file is read again for every poll so
+// agents can be added and removed at runtime.
+func (a *aggregator) agentURLs() []string {
+	var urls = append([]string{}, a.list...)
+	if a.file != "" {
+		file, err := os.Open(a.file)
+		if err != nil {
+			logError("reading agents file failed", "error", err)
+		} else {
+			scanner := bufio.NewScanner(file)
+			for scanner.Scan() {
+				var line = strings.TrimSpace(scanner.Text())
+				if line != "" && !strings.HasPrefix(line, "#") {
+					urls = append(urls, line)
+				}
+			}
+			file.Close()
+		}
+	}
+	for i, url := range urls {
+		if !strings.Contains(url, "://") {
+			url = "http://" + url
+		}
+		urls[i] = strings.TrimSuffix(url, "/")
+	}
+	return urls
+}
+
+// scrape reads all stats types of an agent, all within the timeout.
+func (a *aggregator) scrape(url string) (statsSample, error) {
+	var sample statsSample
+	ctx, cancel := context.WithTimeout(context.Background(), a.timeout)
+	defer cancel()
+
+	for _, statsType := range statsTypes {
+		request, err := http.NewRequestWithContext(ctx, http.MethodGet, url+"/api/v1/stats/"+statsType, nil)
+		if err != nil {
+			return sample, err
+		}
+		if a.token != "" {
+			request.Header.Set("Authorization", "Bearer "+a.token)
+		}
+		response, err := a.client.Do(request)
+		if err != nil {
+			return sample, err
+		}
+		var envelope struct {
+			apiEnvelope
+			Data []statsRow `json:"data"`
+		}
+		err = json.NewDecoder(response.Body).Decode(&envelope)
+		response.Body.Close()
+		if response.StatusCode != http.StatusOK {
+			return sample, fmt.Errorf("%s: HTTP %d %s", statsType, response.StatusCode, envelope.Error)
+		}
+		if err != nil {
+			return sample, fmt.Errorf("%s: %v", statsType, err)
+		}
+		if envelope.SchemaVersion != apiSchemaVersion {
+			return sample, fmt.Errorf("unsupported API schema version %d", envelope.SchemaVersion)
+		}
+
+		sample.Time, sample.Host, sample.Interval = envelope.Timestamp, envelope.Host, envelope.Interval
+		for _, row := range envelope.Data {
+			var device = row.Device
+			if row.Server != "" {
+				device = row.Server + "/" + device
+			}
+			for counter, value := range row.Counters {
+				switch statsType {
+				case "mdt":
+					sample.MDT = addSampleValue(sample.MDT, device, counter, value)
+				case "ost":
+					sample.OST = addSampleValue(sample.OST, device, counter, value)
+				case "client":
+					sample.Client = addSampleValue(sample.Client, device, counter, value)
+				case "mdtjob":
+					sample.MDTJob = addSampleJobValue(sample.MDTJob, device, row.Job, counter, value)
+				case "ostjob":
+					sample.OSTJob = addSampleJobValue(sample.OSTJob, device, row.Job, counter, value)
+				}
+			}
+		}
+	}
+	return sample, nil
+}
+
+// poll scrapes all agents concurrently. An agent which doesn't answer within the timeout is marked down and
+// left out of the merged stats until it answers again.
+func (a *aggregator) poll() {
+	var urls = a.agentURLs()
+
+	a.Lock()
+	var current = make(map[string]*agent)
+	for _, url := range urls {
+		if known, found := a.agents[url]; found {
+			current[url] = known
+		} else {
+			current[url] = &agent{URL: url}
+		}
+	}
+	a.agents = current
+	a.Unlock()
+
+	var wg sync.WaitGroup
+	for _, url := range urls {
+		wg.Add(1)
+		go func(url string) {
+			defer wg.Done()
+			sample, err := a.scrape(url)
+
+			a.Lock()
+			defer a.Unlock()
+			var state = a.agents[url]
+			if err != nil {
+				if state.Up || state.Failures == 0 {
+					logError("agent is not answering", "agent", url, "error", err)
+				}
+				state.Up = false
+				state.Error = err.Error()
+				state.Failures++
+				state.sample = statsSample{}
+				return
+			}
+			if !state.Up && state.Failures > 0 {
+				logInfo("agent is answering again", "agent", url)
+			}
+			var now = time.Now()
+			state.Up, state.Error, state.Failures = true, "", 0
+			state.LastSeen = &now
+			state.Host = sample.Host
+			state.sample = sample
+		}(url)
+	}
+	wg.Wait()
+}
+
+// merge combines the stats of all agents which are up.
+func (a *aggregator) merge() statsSample {
+	a.Lock()
+	defer a.Unlock()
+
+	var up int
+	var merged = statsSample{
+		Time:     time.Now(),
+		Interval: interval,
+		MDT:      make(map[string]map[string]uint64),
+		OST:      make(map[string]map[string]uint64),
+		Client:   make(map[string]map[string]uint64),
+		MDTJob:   make(map[string]map[string]map[string]uint64),
+		OSTJob:   make(map[string]map[string]map[string]uint64),
+	}
+	var hosts = make(map[string]int)
+	for _, state := range a.agents {
+		hosts[state.Host]++
+	}
+	for _, state := range a.agents {
+		if !state.Up {
+			continue
+		}
+		up++
+		// Agents reporting the same hostname, e.g. several lure instances on one host, are told apart by URL.
+		var server = state.Host
+		if server == "" || hosts[server] > 1 {
+			server = strings.TrimPrefix(strings.TrimPrefix(state.URL, "http://"), "https://")
+		}
+		for device, counters := range state.sample.MDT {
+			merged.MDT[server+"/"+device] = counters
+		}
+		for device, counters := range state.sample.OST {
+			merged.OST[server+"/"+device] = counters
+		}
+		for device, counters := range state.sample.Client {
+			merged.Client[server+"/"+device] = counters
+		}
+		for device, jobs := range state.sample.MDTJob {
+			merged.MDTJob[server+"/"+device] = jobs
+		}
+		for device, jobs := range state.sample.OSTJob {
+			merged.OSTJob[server+"/"+device] = jobs
+		}
+	}
+	merged.Host = fmt.Sprintf("cluster, %d of %d agents", up, len(a.agents))
+	return merged
+}
+
+// status returns all agents sorted by URL.
+func (a *aggregator) status() []agent {
+	a.Lock()
+	defer a.Unlock()
+
+	var status = []agent{}
+	for _, state := range a.agents {
+		status = append(status, *state)
+	}
+	sort.Slice(status, func(i, j int) bool { return status[i].URL < status[j].URL })
+	return status
+}
+
+// down returns the agents which are not answering.
+func (a *aggregator) down() []string {
+	var down = []string{}
+	for _, state := range a.status() {
+		if !state.Up {
+			down = append(down, state.URL)
+		}
+	}
+	return down
+}
+
+// printAgents shows the agents which are not answering below the stats tables.
+func (a *aggregator) printAgents() {
+	var status = a.status()
+	var down = a.down()
+	fmt.Println()
+	fmt.Println(tm.Bold(fmt.Sprintf("Agents: %d of %d answering", len(status)-len(down), len(status))))
+	for _, state := range status {
+		if !state.Up {
+			var lastSeen = "never"
+			if state.LastSeen != nil {
+				lastSeen = state.LastSeen.Format("15:04:05")
+			}
+			fmt.Println(tm.Color(fmt.Sprintf("  DOWN %s (last seen %s): %s", state.URL, lastSeen, state.Error), tm.RED))
+		}
+	}
+}
+
+// printTotals shows the filesystem wide OST bandwidth and MDT operations.
+func printTotals(sample statsSample) {
+	for _, section := range []struct {
+		title    string
+		stats    string
+		counters []string
+	}{
+		{"Filesystem MDT Totals /s:", "mdt", mdtCounters},
+		{"Filesystem OST Totals /s:", "ost", ostCounters},
+	} {
+		var totals = make(map[string]map[string]uint64)
+		for _, row := range statsTotals(sample, section.stats, statsFilter{}) {
+			totals[row.Device] = row.Counters
+		}
+		if len(totals) > 0 {
+			fmt.Println()
+			fmt.Println(tm.Bold(section.title))
+			printStats(totals, sortStatsMapIntoSlice(totals), section.counters)
+		}
+	}
+}
+
+// apiAgents serves /api/v1/agents, the state of every agent.
+func apiAgents(w http.ResponseWriter, r *http.Request) {
+	apiWrite(w, http.StatusOK, apiEnvelope{Timestamp: sampleTime, Interval: interval, Host: hostname,
+		Data: agents.status()})
+}
+
+// runAggregate implements "lure aggregate", polling many lure agents and serving the merged stats.
+func runAggregate(args []string) {
+	var agentList, tokenFile, caFile string
+	var daemon bool
+
+	flags := flag.NewFlagSet("aggregate", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s aggregate [options]\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	addHTTPFlags(flags)
+	addHistoryFlags(flags)
+	addJobFlags(flags)
+	addJobIDFlags(flags)
+	addCounterFlags(flags)
+	addBatchFlags(flags)
+	addShutdownFlags(flags)
+	addLogFlags(flags)
+	flags.IntVar(&interval, "interval", 5, "Poll interval in seconds")
+	flags.StringVar(&agentList, "agents", "", "Comma separated agent URLs, e.g. http://oss01:8666,https://oss02:8666")
+	flags.StringVar(&agents.file, "agentsfile", "", "File with one agent URL per line, read again before every poll")
+	flags.StringVar(&tokenFile, "agenttokenfile", "", "File with the bearer token sent to the agents")
+	flags.StringVar(&caFile, "agentca", "", "CA certificate file to verify agents served via HTTPS")
+	flags.DurationVar(&agents.timeout, "agenttimeout", 0, "Timeout for polling an agent (default the poll interval)")
+	flags.BoolVar(&daemon, "daemon", false, "No console output, the stats are only available via the web interface.")
+	_ = flags.Parse(args)
+
+	if interval < 1 {
+		log.Fatalln("The -interval must be at least one second.")
+	}
+	if agentList != "" {
+		agents.list = strings.Split(agentList, ",")
+	}
+	if len(agents.agentURLs()) == 0 && agents.file == "" {
+		flags.Usage()
+		os.Exit(2)
+	}
+	if agents.timeout == 0 {
+		agents.timeout = time.Duration(interval) * time.Second
+	}
+
+	var transport = http.DefaultTransport.(*http.Transport).Clone()
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			log.Fatalf("Can't read the agent CA: %v", err)
+		}
+		var pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			log.Fatalf("No certificates found in %s", caFile)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	agents.client = &http.Client{Transport: transport}
+	if tokenFile != "" {
+		token, err := ioutil.ReadFile(tokenFile)
+		if err != nil {
+			log.Fatalf("Can't read the agent token: %v", err)
+		}
+		agents.token = strings.TrimSpace(string(token))
+	}
+	if err := history.setup(historyTiers, historyMaxMem); err != nil {
+		log.Fatalf("Invalid -history: %v", err)
+	}
+	if err := setupCounters(); err != nil {
+		log.Fatalf("Invalid counter list %v", err)
+	}
+	if err := validateJobOptions(jobMode, jobSortBy); err != nil {
+		log.Fatalf("Invalid -jobmode or -jobsort: %v", err)
+	}
+	if err := setupJobIDs(); err != nil {
+		log.Fatalf("Invalid job ID options: %v", err)
+	}
+	if err := validateBatchOptions(); err != nil {
+		log.Fatalf("Invalid batch options: %v", err)
+	}
+	if err := setupLogging(); err != nil {
+		log.Fatalf("Invalid logging options: %v", err)
+	}
+
+	aggregating = true
+	http.HandleFunc("/api/v1/agents", apiAgents)
+	startShutdownHandler()
+	if noHTTP != true {
+		startHTTPServer(listenAddresses(httpListen, httpPort))
+	}
+
+	for {
+		var start = time.Now()
+		agents.poll()
+		var sample = agents.merge()
+		applySample(sample)
+		// The client view hides the MDT and OST sections, it is only used if none of the agents is a server.
+		client = len(sample.MDT) == 0 && len(sample.OST) == 0 && len(sample.Client) > 0
+		if batchMode {
+			printBatch(sample)
+		} else if !daemon {
+			printConsole()
+			printTotals(sample)
+			agents.printAgents()
+		}
+		feedSinks()
+		if countSample() || waitForNextSample(time.Until(start.Add(time.Duration(interval)*time.Second))) {
+			shutdown()
+		}
+	}
+}
@@ -0,0 +1,399 @@
+/*
+MIT License
+
+Copyright (c) 2020 storagebit.ch
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// apiSchemaVersion changes whenever the /api/v1/ responses change in an incompatible way.
+const apiSchemaVersion = 1
+
+// statsTypes are the stats types known to the API, the stream, the sinks and the recordings.
+var statsTypes = []string{"mdt", "ost", "client", "mdtjob", "ostjob"}
+
+// apiEnvelope wraps every /api/v1/ response.
+type apiEnvelope struct {
+	SchemaVersion int         `json:"schema_version"`
+	Timestamp     time.Time   `json:"timestamp"`
+	Interval      int         `json:"interval"`
+	Host          string      `json:"host"`
+	Stats         string      `json:"stats,omitempty"`
+	Data          interface{} `json:"data,omitempty"`
+	Error         string      `json:"error,omitempty"`
+}
+
+// statsRow is one device, or one job on a device, in an /api/v1/stats response. The server is only set by
+// lure aggregate.
+type statsRow struct {
+	Server   string            `json:"server,omitempty"`
+	Device   string            `json:"device"`
+	Job      string            `json:"job,omitempty"`
+	JobID    *jobID            `json:"jobid,omitempty"`
+	Counters map[string]uint64 `json:"counters"`
+}
+
+// statsFilter selects servers, devices and jobs by glob pattern, e.g. "*OST000[0-3]", and optionally only some
+// counters. Empty patterns and a nil counter set select everything.
+type statsFilter struct {
+	server   string
+	device   string
+	job      string
+	counters map[string]bool
+}
+
+func parseStatsFilter(query url.Values) (statsFilter, error) {
+	var filter = statsFilter{server: query.Get("server"), device: query.Get("device"), job: query.Get("job")}
+	if err := filter.validate(); err != nil {
+		return filter, err
+	}
+	if counters := query.Get("counters"); counters != "" {
+		filter.counters = make(map[string]bool)
+		for _, counter := range strings.Split(counters, ",") {
+			filter.counters[counter] = true
+		}
+	}
+	return filter, nil
+}
+
+// validate checks the glob patterns, matching never fails afterwards.
+func (f statsFilter) validate() error {
+	for _, pattern := range []string{f.server, f.device, f.job} {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q", pattern)
+		}
+	}
+	return nil
+}
+
+func matches(pattern string, name string) bool {
+	if pattern == "" {
+		return true
+	}
+	matched, _ := path.Match(pattern, name)
+	return matched
+}
+
+// splitServer splits the "server/device" names of lure aggregate. The server is empty for local devices.
+func splitServer(name string) (string, string) {
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		return name[:i], name[i+1:]
+	}
+	return "", name
+}
+
+// filesystemOf returns the filesystem of a target or client mount, e.g. testfs for testfs-OST0000.
+func filesystemOf(device string) string {
+	if i := strings.LastIndex(device, "-"); i > 0 {
+		return device[:i]
+	}
+	return device
+}
+
+func (f statsFilter) matchDevice(name string) bool {
+	var server, device = splitServer(name)
+	return matches(f.server, server) && matches(f.device, device)
+}
+
+func (f statsFilter) selectCounters(counters map[string]uint64) map[string]uint64 {
+	if f.counters == nil {
+		return counters
+	}
+	var selected = make(map[string]uint64)
+	for counter, value := range counters {
+		if f.counters[counter] {
+			selected[counter] = value
+		}
+	}
+	return selected
+}
+
+func (f statsFilter) filterStats(stats map[string]map[string]uint64) map[string]map[string]uint64 {
+	var filtered = make(map[string]map[string]uint64)
+	for device, counters := range stats {
+		if f.matchDevice(device) {
+			filtered[device] = f.selectCounters(counters)
+		}
+	}
+	return filtered
+}
+
+func (f statsFilter) filterJobStats(stats map[string]map[string]map[string]uint64) map[string]map[string]map[string]uint64 {
+	var filtered = make(map[string]map[string]map[string]uint64)
+	for device, jobs := range stats {
+		if !f.matchDevice(device) {
+			continue
+		}
+		for job, counters := range jobs {
+			if matches(f.job, job) {
+				if filtered[device] == nil {
+					filtered[device] = make(map[string]map[string]uint64)
+				}
+				filtered[device][job] = f.selectCounters(counters)
+			}
+		}
+	}
+	return filtered
+}
+
+// countersOf returns the counters reported for a stats type.
+func countersOf(statsType string) []string {
+	switch statsType {
+	case "mdt":
+		return mdtCounters
+	case "ost":
+		return ostCounters
+	case "client":
+		return lliteCounters
+	case "mdtjob":
+		return mdtJobStatsCounters
+	case "ostjob":
+		return ostJobStatsCounters
+	}
+	return nil
+}
+
+// availableCounters returns the counters of a stats type, sorted. The displayed counters are only a selection,
+// the sample carries every counter found in the stats files. nil for an unknown stats type.
+func availableCounters(sample statsSample, statsType string) []string {
+	var displayed = countersOf(statsType)
+	if displayed == nil {
+		return nil
+	}
+	var known = make(map[string]bool)
+	for _, counter := range displayed {
+		known[counter] = true
+	}
+	for _, row := range statsRows(sample, statsType, statsFilter{}) {
+		for counter := range row.Counters {
+			known[counter] = true
+		}
+	}
+	var counters []string
+	for counter := range known {
+		counters = append(counters, counter)
+	}
+	sort.Strings(counters)
+	return counters
+}
+
+// statsRows returns the filtered stats of one type of a sample, sorted by device and job.
+func statsRows(sample statsSample, statsType string, filter statsFilter) []statsRow {
+	var rows = []statsRow{}
+	var stats map[string]map[string]uint64
+	var jobStats map[string]map[string]map[string]uint64
+
+	switch statsType {
+	case "mdt":
+		stats = sample.MDT
+	case "ost":
+		stats = sample.OST
+	case "client":
+		stats = sample.Client
+	case "mdtjob":
+		jobStats = sample.MDTJob
+	case "ostjob":
+		jobStats = sample.OSTJob
+	}
+
+	var filtered = filter.filterStats(stats)
+	for _, name := range sortStatsMapIntoSlice(filtered) {
+		var server, device = splitServer(name)
+		rows = append(rows, statsRow{Server: server, Device: device, Counters: filtered[name]})
+	}
+	var filteredJobs = filter.filterJobStats(jobStats)
+	for _, deviceJob := range sortJobsMapIntoSlice(filteredJobs) {
+		var name, job, _ = strings.Cut(deviceJob, "@@")
+		var server, device = splitServer(name)
+		rows = append(rows, statsRow{Server: server, Device: device, Job: job, JobID: parseJobID(job),
+			Counters: filteredJobs[name][job]})
+	}
+	return rows
+}
+
+// statsTotals sums the filtered stats of one type per filesystem, job stats per filesystem and job. The device
+// of the rows is the filesystem.
+func statsTotals(sample statsSample, statsType string, filter statsFilter) []statsRow {
+	var totals = make(map[string]map[string]uint64)
+	for _, row := range statsRows(sample, statsType, filter) {
+		var key = filesystemOf(row.Device) + "@@" + row.Job
+		if totals[key] == nil {
+			totals[key] = make(map[string]uint64)
+		}
+		for counter, value := range row.Counters {
+			totals[key][counter] += value
+		}
+	}
+	var rows = []statsRow{}
+	for _, key := range sortStatsMapIntoSlice(totals) {
+		var filesystem, job, _ = strings.Cut(key, "@@")
+		rows = append(rows, statsRow{Device: filesystem, Job: job, Counters: totals[key]})
+	}
+	return rows
+}
+
+// topStatsRows sorts the rows by a counter, highest first, and keeps the top ones. top 0 keeps all rows.
+func topStatsRows(rows []statsRow, counter string, top int) []statsRow {
+	if counter != "" {
+		sort.SliceStable(rows, func(i, j int) bool {
+			return rows[i].Counters[counter] > rows[j].Counters[counter]
+		})
+	}
+	if top > 0 && top < len(rows) {
+		rows = rows[:top]
+	}
+	return rows
+}
+
+func apiWrite(w http.ResponseWriter, status int, envelope apiEnvelope) {
+	envelope.SchemaVersion = apiSchemaVersion
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(envelope)
+}
+
+func apiError(w http.ResponseWriter, status int, format string, args ...interface{}) {
+	apiWrite(w, status, apiEnvelope{Timestamp: time.Now(), Host: hostname, Interval: interval,
+		Error: fmt.Sprintf(format, args...)})
+}
+
+// apiStats serves /api/v1/stats/<type> and /api/v1/totals/<type> with the rows returned by statsRows or
+// statsTotals. Query parameters are server, device, job, counters, sort and top.
+func apiStats(rowsOf func(statsSample, string, statsFilter) []statsRow) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		apiRows(w, r, rowsOf)
+	}
+}
+
+func apiRows(w http.ResponseWriter, r *http.Request, rowsOf func(statsSample, string, statsFilter) []statsRow) {
+	var statsType = path.Base(r.URL.Path)
+	var counters = countersOf(statsType)
+	if counters == nil {
+		apiError(w, http.StatusNotFound, "unknown stats type %q, use one of %s", statsType,
+			strings.Join(statsTypes, ", "))
+		return
+	}
+
+	var query = r.URL.Query()
+	filter, err := parseStatsFilter(query)
+	if err != nil {
+		apiError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	var top int
+	if value := query.Get("top"); value != "" {
+		if top, err = strconv.Atoi(value); err != nil || top < 1 {
+			apiError(w, http.StatusBadRequest, "invalid top %q", value)
+			return
+		}
+	}
+
+	// Sorting by a counter which isn't selected still has to see its values.
+	var rows = rowsOf(currentSample(), statsType, statsFilter{server: filter.server, device: filter.device,
+		job: filter.job})
+
+	// The displayed counters are only a selection, the rows carry every counter found in the stats files.
+	var known = make(map[string]bool)
+	for _, counter := range counters {
+		known[counter] = true
+	}
+	for _, row := range rows {
+		for counter := range row.Counters {
+			known[counter] = true
+		}
+	}
+	for counter := range filter.counters {
+		if !known[counter] {
+			apiError(w, http.StatusBadRequest, "unknown %s counter %q", statsType, counter)
+			return
+		}
+	}
+	var sortBy = query.Get("sort")
+	if sortBy != "" && !known[sortBy] {
+		apiError(w, http.StatusBadRequest, "unknown %s counter %q to sort by", statsType, sortBy)
+		return
+	}
+	rows = topStatsRows(rows, sortBy, top)
+	for i := range rows {
+		rows[i].Counters = filter.selectCounters(rows[i].Counters)
+	}
+	apiWrite(w, http.StatusOK, apiEnvelope{Timestamp: sampleTime, Interval: interval, Host: hostname,
+		Stats: statsType, Data: rows})
+}
+
+// apiInfo serves /api/v1/info, the stats types available, their counters and the collectors.
+func apiInfo(w http.ResponseWriter, r *http.Request) {
+	var counters = make(map[string][]string)
+	for _, statsType := range statsTypes {
+		counters[statsType] = countersOf(statsType)
+	}
+	apiWrite(w, http.StatusOK, apiEnvelope{Timestamp: sampleTime, Interval: interval, Host: hostname,
+		Data: map[string]interface{}{
+			"build":      buildSha1,
+			"client":     client,
+			"counters":   counters,
+			"collectors": collectorStatuses(),
+		}})
+}
+
+// apiMetrics serves /api/v1/metrics, lure's own metrics per collector, sink and the web interface.
+func apiMetrics(w http.ResponseWriter, r *http.Request) {
+	apiWrite(w, http.StatusOK, apiEnvelope{Timestamp: sampleTime, Interval: interval, Host: hostname,
+		Data: lureMetrics.snapshot()})
+}
+
+// apiOpenAPI serves the OpenAPI specification of /api/v1/.
+func apiOpenAPI(w http.ResponseWriter, r *http.Request) {
+	spec, _ := webFiles.ReadFile("web/openapi.json")
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(spec)
+}
+
+func apiNotFound(w http.ResponseWriter, r *http.Request) {
+	apiError(w, http.StatusNotFound, "unknown API endpoint %s", r.URL.Path)
+}
+
+func registerAPIHandlers() {
+	http.HandleFunc("/api/v1/", apiNotFound)
+	http.HandleFunc("/api/v1/info", apiInfo)
+	http.HandleFunc("/api/v1/stats/", apiStats(statsRows))
+	http.HandleFunc("/api/v1/totals/", apiStats(statsTotals))
+	http.HandleFunc("/api/v1/jobs", apiJobs)
+	http.HandleFunc("/api/v1/jobs/devices", apiJobDevices)
+	http.HandleFunc("/api/v1/jobs/recent", apiRecentJobs)
+	http.HandleFunc("/api/v1/history", apiHistory)
+	http.HandleFunc("/api/v1/history/usage", apiHistoryUsage)
+	http.HandleFunc("/api/v1/reload", apiReload)
+	http.HandleFunc("/api/v1/metrics", apiMetrics)
+	http.HandleFunc("/api/v1/openapi.json", apiOpenAPI)
+}
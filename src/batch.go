@@ -0,0 +1,152 @@
+/*
+MIT License
+
+Copyright (c) 2020 storagebit.ch
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Batch mode prints every sample as plain lines appended to stdout, like top -b. It is meant for piping into
+// files, awk or other tools, so there are no escape codes and every line carries the sample time.
+var batchMode bool
+var batchFormat string
+var sampleCount int
+
+var batchSamples int
+var batchHeaderDone bool
+var batchOut = bufio.NewWriter(os.Stdout)
+
+// addBatchFlags registers the batch mode flags on a flag set.
+func addBatchFlags(flags *flag.FlagSet) {
+	flags.BoolVar(&batchMode, "batch", false, "Print every sample as plain lines to stdout instead of the interactive console, like top -b")
+	flags.StringVar(&batchFormat, "batchformat", "table", "Batch output format, table, csv, tsv or jsonl")
+	flags.IntVar(&sampleCount, "count", 0, "Exit after this many samples, 0 runs forever")
+}
+
+// validateBatchOptions checks the batch flags.
+func validateBatchOptions() error {
+	switch batchFormat {
+	case "table", "csv", "tsv", "jsonl":
+	default:
+		return fmt.Errorf("invalid batch format %q, use table, csv, tsv or jsonl", batchFormat)
+	}
+	if sampleCount < 0 {
+		return fmt.Errorf("invalid -count %d, use 0 or a positive number of samples", sampleCount)
+	}
+	return nil
+}
+
+// printBatch appends a sample to stdout in the selected batch format.
+func printBatch(sample statsSample) {
+	switch batchFormat {
+	case "csv", "tsv":
+		var comma = ','
+		if batchFormat == "tsv" {
+			comma = '\t'
+		}
+		if !batchHeaderDone {
+			_, _ = batchOut.WriteString(strings.Join(csvHeader, string(comma)) + "\n")
+			batchHeaderDone = true
+		}
+		_, _ = batchOut.Write(encodeSampleCSV(sample, comma))
+	case "jsonl":
+		data, err := json.Marshal(sample)
+		if err != nil {
+			logError("encoding sample failed", "error", err)
+			return
+		}
+		_, _ = batchOut.Write(append(data, '\n'))
+	default:
+		printBatchTable(sample)
+	}
+	checkContinue(batchOut.Flush())
+}
+
+// printBatchTable prints one aligned table per stats type, every line starts with the sample time so that the
+// output can still be grepped once several samples are appended. Names are left and counters right aligned.
+func printBatchTable(sample statsSample) {
+	var timestamp = sample.Time.Format(time.RFC3339)
+	fmt.Fprintf(batchOut, "%s Lustre node: %s | Sample Interval: %ds\n", timestamp, sample.Host, sample.Interval)
+
+	for _, statsType := range statsTypes {
+		var rows = statsRows(sample, statsType, statsFilter{})
+		if len(rows) == 0 {
+			continue
+		}
+		var counters = countersOf(statsType)
+		var names = 1
+		if strings.HasSuffix(statsType, "job") {
+			names = 2
+		}
+
+		var header = []string{"device", "job"}[:names]
+		var lines = [][]string{append(header, counters...)}
+		for _, row := range rows {
+			var device = row.Device
+			if row.Server != "" {
+				device = row.Server + "/" + device
+			}
+			var line = []string{device, row.Job}[:names]
+			for _, counter := range counters {
+				line = append(line, strconv.FormatUint(row.Counters[counter], 10))
+			}
+			lines = append(lines, line)
+		}
+
+		var widths = make([]int, len(lines[0]))
+		for _, line := range lines {
+			for i, cell := range line {
+				if len(cell) > widths[i] {
+					widths[i] = len(cell)
+				}
+			}
+		}
+		for _, line := range lines {
+			fmt.Fprintf(batchOut, "%s %-6s", timestamp, statsType)
+			for i, cell := range line {
+				if i < names {
+					fmt.Fprintf(batchOut, " %-*s", widths[i], cell)
+				} else {
+					fmt.Fprintf(batchOut, " %*s", widths[i], cell)
+				}
+			}
+			fmt.Fprintln(batchOut)
+		}
+	}
+	fmt.Fprintln(batchOut)
+}
+
+// countSample is called once per sample and reports whether -count samples have been shown.
+func countSample() bool {
+	batchSamples++
+	return sampleCount > 0 && batchSamples >= sampleCount
+}
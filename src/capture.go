@@ -0,0 +1,351 @@
+/*
+MIT License
+
+Copyright (c) 2020 storagebit.ch
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+// A capture bundle is a tar.gz with the raw stats files of every iteration, stored as
+// <iteration>/<mdt|ost|client|...>/<device>/<md_stats|stats|job_stats|...>, and a manifest.json describing the
+// node. Every registered collector which reads a stats file per device is captured.
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	tm "github.com/buger/goterm"
+)
+
+const captureManifest = "manifest.json"
+
+// captureManifestData describes the node and the iterations of a capture bundle.
+type captureManifestData struct {
+	Hostname      string                       `json:"hostname"`
+	LustreVersion string                       `json:"lustre_version"`
+	LureVersion   string                       `json:"lure_version"`
+	Interval      int                          `json:"interval"`
+	Timestamps    []time.Time                  `json:"timestamps"`
+	Devices       map[string]map[string]string `json:"devices"`
+}
+
+// lustreVersion returns the version reported by the Lustre modules, newer releases moved it to sysfs.
+func lustreVersion() string {
+	for _, file := range []string{"/sys/fs/lustre/version", "/proc/fs/lustre/version"} {
+		if version, err := ioutil.ReadFile(file); err == nil {
+			return strings.TrimSpace(string(version))
+		}
+	}
+	return "unknown"
+}
+
+// writeCaptureFile adds a single file to the bundle.
+func writeCaptureFile(tw *tar.Writer, name string, data []byte, modTime time.Time) error {
+	var header = &tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), ModTime: modTime, Typeflag: tar.TypeReg}
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err := tw.Write(data)
+	return err
+}
+
+// writeCaptureFiles adds the raw stats of one stats type and iteration to the bundle.
+func writeCaptureFiles(tw *tar.Writer, iteration int, statsType string, fileName string, mapRaw map[string][]byte,
+	modTime time.Time) error {
+
+	for device, raw := range mapRaw {
+		var name = path.Join(fmt.Sprintf("%04d", iteration), statsType, device, fileName)
+		if err := writeCaptureFile(tw, name, raw, modTime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// capture reads the raw stats files count times and writes them into the bundle.
+func capture(output string, count int, withJobStats bool) error {
+	file, err := os.Create(output)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	zw := gzip.NewWriter(file)
+	tw := tar.NewWriter(zw)
+
+	var manifest = captureManifestData{
+		Hostname:      hostname,
+		LustreVersion: lustreVersion(),
+		LureVersion:   buildSha1,
+		Interval:      interval,
+		Devices:       make(map[string]map[string]string),
+	}
+
+	collectorsLock.Lock()
+	var captured []*collectorState
+	for _, state := range collectors {
+		var info = state.collector.Describe()
+		if _, ok := state.collector.(captureCollector); !ok {
+			logWarn("collector has no stats files to capture", "collector", info.StatsType)
+			continue
+		}
+		if info.Jobs && !withJobStats {
+			continue
+		}
+		captured = append(captured, state)
+	}
+	collectorsLock.Unlock()
+	for _, state := range captured {
+		var dir, _, files = state.collector.(captureCollector).CaptureFiles()
+		// The devices of the job stats are those of the MDT and OST collectors.
+		if _, found := manifest.Devices[dir]; !found {
+			manifest.Devices[dir] = files
+		}
+	}
+
+	for iteration := 0; iteration < count; iteration++ {
+		if iteration > 0 {
+			time.Sleep(time.Duration(interval) * time.Second)
+		}
+		var now = time.Now()
+		manifest.Timestamps = append(manifest.Timestamps, now)
+
+		for _, state := range captured {
+			var dir, fileName, files = state.collector.(captureCollector).CaptureFiles()
+			var mapRaw = readFiles(state.collector.Describe().StatsType, files)
+			if err := writeCaptureFiles(tw, iteration, dir, fileName, mapRaw, now); err != nil {
+				return err
+			}
+		}
+		logInfo("captured iteration", "iteration", iteration+1, "count", count)
+	}
+
+	jsonData, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeCaptureFile(tw, captureManifest, jsonData, time.Now()); err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// captureIteration holds the raw files of one iteration by "<stats type>/<file name>" and device, the same
+// per device maps readStatsFile and readJobStatsFile return.
+type captureIteration map[string]map[string][]byte
+
+func (c captureIteration) raw(statsType string, fileName string) map[string][]byte {
+	if c[statsType+"/"+fileName] == nil {
+		return make(map[string][]byte)
+	}
+	return c[statsType+"/"+fileName]
+}
+
+// loadCapture reads a bundle written by capture.
+func loadCapture(bundle string) (captureManifestData, []captureIteration, error) {
+	var manifest captureManifestData
+
+	file, err := os.Open(bundle)
+	if err != nil {
+		return manifest, nil, err
+	}
+	defer file.Close()
+	zr, err := gzip.NewReader(file)
+	if err != nil {
+		return manifest, nil, err
+	}
+	tr := tar.NewReader(zr)
+
+	var mapFiles = make(map[string][]byte)
+	var foundManifest bool
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return manifest, nil, err
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return manifest, nil, err
+		}
+		if header.Name == captureManifest {
+			if err := json.Unmarshal(data, &manifest); err != nil {
+				return manifest, nil, fmt.Errorf("%s: %v", captureManifest, err)
+			}
+			foundManifest = true
+		} else {
+			mapFiles[header.Name] = data
+		}
+	}
+	if !foundManifest {
+		return manifest, nil, errors.New("no " + captureManifest + " found, not a lure capture bundle")
+	}
+
+	var iterations = make([]captureIteration, len(manifest.Timestamps))
+	for name, data := range mapFiles {
+		// <iteration>/<stats type>/<device>/<file name>
+		var parts = strings.Split(name, "/")
+		if len(parts) != 4 {
+			continue
+		}
+		var index int
+		if _, err := fmt.Sscanf(parts[0], "%d", &index); err != nil || index < 0 || index >= len(iterations) {
+			continue
+		}
+		if iterations[index] == nil {
+			iterations[index] = make(captureIteration)
+		}
+		var key = parts[1] + "/" + parts[3]
+		if iterations[index][key] == nil {
+			iterations[index][key] = make(map[string][]byte)
+		}
+		iterations[index][key][parts[2]] = data
+	}
+	return manifest, iterations, nil
+}
+
+// analyzeCapture calculates and prints the rates between every two consecutive iterations of the bundle.
+func analyzeCapture(bundle string) error {
+	manifest, iterations, err := loadCapture(bundle)
+	if err != nil {
+		return err
+	}
+	if len(iterations) < 2 {
+		return errors.New("at least two iterations are required to calculate rates")
+	}
+
+	fmt.Printf("Host: %s | Lustre: %s | Iterations: %d | Interval: %ds\n", manifest.Hostname, manifest.LustreVersion,
+		len(iterations), manifest.Interval)
+	var slcTypes []string
+	for statsType := range manifest.Devices {
+		slcTypes = append(slcTypes, statsType)
+	}
+	sort.Strings(slcTypes)
+	for _, statsType := range slcTypes {
+		for device, file := range manifest.Devices[statsType] {
+			fmt.Printf("Device: %s (%s) %s\n", device, statsType, file)
+		}
+	}
+	fmt.Println()
+
+	hostname = manifest.Hostname
+	for i := 1; i < len(iterations); i++ {
+		var prev, next = iterations[i-1], iterations[i]
+
+		// Use the actual time between both reads for the rates and the header.
+		interval = int(manifest.Timestamps[i].Sub(manifest.Timestamps[i-1]).Round(time.Second).Seconds())
+		if interval < 1 {
+			interval = 1
+		}
+		var seconds = uint64(interval)
+		sampleTime = manifest.Timestamps[i]
+
+		mapMDTCalcStats = calcStats(parseRAWSats(prev.raw("mdt", "md_stats"), "mdt"),
+			parseRAWSats(next.raw("mdt", "md_stats"), "mdt"), seconds)
+		mapOSTCalcStats = calcStats(parseRAWSats(prev.raw("ost", "stats"), "ost"),
+			parseRAWSats(next.raw("ost", "stats"), "ost"), seconds)
+		mapLliteCalcStats = calcStats(parseRAWSats(prev.raw("client", "stats"), "client"),
+			parseRAWSats(next.raw("client", "stats"), "client"), seconds)
+		mapMDTJobStats = calcJobStats(parseRAWJobStats(prev.raw("mdt", "job_stats"), "mdtjob"),
+			parseRAWJobStats(next.raw("mdt", "job_stats"), "mdtjob"), seconds)
+		mapOSTJobStats = calcJobStats(parseRAWJobStats(prev.raw("ost", "job_stats"), "ostjob"),
+			parseRAWJobStats(next.raw("ost", "job_stats"), "ostjob"), seconds)
+		client = len(mapLliteCalcStats) > 0
+
+		sortedMTDDevices = sortStatsMapIntoSlice(mapMDTCalcStats)
+		sortedOSTDevices = sortStatsMapIntoSlice(mapOSTCalcStats)
+		sortedLliteFilesystems = sortStatsMapIntoSlice(mapLliteCalcStats)
+		sortedMDTJobs = sortJobsMapIntoSlice(mapMDTJobStats)
+		sortedOSTJobs = sortJobsMapIntoSlice(mapOSTJobStats)
+
+		fmt.Println(tm.Bold(statsHeader()))
+		printStatsTables()
+		fmt.Println()
+	}
+	return nil
+}
+
+// runCapture implements "lure capture [options]".
+func runCapture(args []string) {
+	var output string
+	var count int
+	var withJobStats bool
+
+	flags := flag.NewFlagSet("capture", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s capture [options]\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.IntVar(&interval, "interval", 1, "Time between two iterations in seconds")
+	flags.IntVar(&count, "count", 10, "Number of iterations to capture")
+	flags.BoolVar(&withJobStats, "jobstats", true, "Capture the MDT and OST job_stats files too")
+	flags.StringVar(&output, "o", "lure-capture-"+hostname+"-"+time.Now().Format(recordTimeFormat)+".tar.gz",
+		"Bundle file to write")
+	_ = flags.Parse(args)
+
+	if count < 1 || interval < 1 || flags.NArg() != 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	discoverDevices()
+
+	if err := capture(output, count, withJobStats); err != nil {
+		log.Fatalf("Capture failed: %v", err)
+	}
+	logInfo("capture written", "file", output)
+}
+
+// runAnalyze implements "lure analyze <bundle>".
+func runAnalyze(args []string) {
+	flags := flag.NewFlagSet("analyze", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s analyze <bundle>\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	if err := analyzeCapture(flags.Arg(0)); err != nil {
+		log.Fatalf("Can't analyze %s: %v", flags.Arg(0), err)
+	}
+}
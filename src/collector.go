@@ -0,0 +1,384 @@
+/*
+MIT License
+
+Copyright (c) 2020 storagebit.ch
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Collector is a source of stats. The main loop only knows the registered collectors, a new source, e.g.
+// brw_stats or LNet, is a new Collector passed to registerCollector.
+type Collector interface {
+	// Describe returns what the collector reports.
+	Describe() collectorInfo
+	// Discover looks for the devices of the collector, at startup and with every reload.
+	Discover() error
+	// Collect reads the current counters of all devices. The collector returns the raw, ever increasing
+	// counters, the rates are calculated by the scheduler.
+	Collect() (collection, error)
+}
+
+// captureCollector is a Collector reading a stats file per device, lure capture stores these files as they
+// are in its bundles.
+type captureCollector interface {
+	// CaptureFiles returns the stats file of every device, the bundle keeps them as <dir>/<device>/<file>.
+	CaptureFiles() (dir string, file string, files map[string]string)
+}
+
+type collectorInfo struct {
+	StatsType   string `json:"stats"`
+	Description string `json:"description"`
+	Jobs        bool   `json:"jobs"`
+	Devices     int    `json:"devices"`
+}
+
+// collection holds the counters by device, for job stats by device and job.
+type collection struct {
+	stats map[string]map[string]uint64
+	jobs  map[string]map[string]map[string]uint64
+}
+
+// collectorState is the schedule of a collector and the counters of its last successful run.
+type collectorState struct {
+	collector Collector
+	enabled   func() bool
+	prev      *collection
+	prevTime  time.Time
+	next      time.Time
+	lastError string
+}
+
+// collectorStatus is a collector as shown by /api/v1/info.
+type collectorStatus struct {
+	collectorInfo
+	Enabled   bool     `json:"enabled"`
+	Interval  int      `json:"interval"`
+	Stale     []string `json:"stale,omitempty"`
+	LastError string   `json:"last_error,omitempty"`
+}
+
+var (
+	collectors = []*collectorState{
+		{collector: lliteCollector{statsFileCollector{"client", "Client operation stats", pathToLliteFilesystems,
+			"stats", &mapLliteFilesystems}}, enabled: func() bool { return client }},
+		{collector: statsFileCollector{"mdt", "MDT metadata stats", pathToMDTs, "md_stats", &mapMDTs},
+			enabled: func() bool { return !ignoreMDTStats && !client }},
+		{collector: statsFileCollector{"ost", "OST operation stats", pathToOSTs, "stats", &mapOSTs},
+			enabled: func() bool { return !ignoreOSTStats && !client }},
+		{collector: jobStatsCollector{"mdtjob", "mdt", &mapMDTs},
+			enabled: func() bool { return reportJobStats && !ignoreMDTStats && !client }},
+		{collector: jobStatsCollector{"ostjob", "obdfilter", &mapOSTs},
+			enabled: func() bool { return reportJobStats && !ignoreOSTStats && !client }},
+	}
+	collectorsLock sync.Mutex
+
+	collectorIntervalsFlag string
+	collectorIntervals     = make(map[string]time.Duration)
+
+	// collectedSeconds holds the seconds the rates of each collector which ran in the last sample cover.
+	collectedSeconds map[string]uint64
+)
+
+// registerCollector adds a collector, it is enabled as long as enabled returns true.
+func registerCollector(c Collector, enabled func() bool) {
+	collectorsLock.Lock()
+	defer collectorsLock.Unlock()
+	collectors = append(collectors, &collectorState{collector: c, enabled: enabled})
+}
+
+func addCollectorFlags(flags *flag.FlagSet) {
+	flags.StringVar(&collectorIntervalsFlag, "collectorintervals", "",
+		"Sample some collectors less often than the interval, e.g. mdtjob=10s,ostjob=30s")
+}
+
+// setupCollectors applies -collectorintervals.
+func setupCollectors() error {
+	var intervals = make(map[string]time.Duration)
+	for _, item := range strings.Split(collectorIntervalsFlag, ",") {
+		if strings.TrimSpace(item) == "" {
+			continue
+		}
+		var statsType, value, found = strings.Cut(item, "=")
+		statsType = strings.TrimSpace(statsType)
+		if !found {
+			return fmt.Errorf("invalid -collectorintervals: %q is not collector=interval", item)
+		}
+		if findCollector(statsType) == nil {
+			return fmt.Errorf("invalid -collectorintervals: unknown collector %q", statsType)
+		}
+		duration, err := time.ParseDuration(strings.TrimSpace(value))
+		if err != nil || duration < time.Second || duration%time.Second != 0 {
+			return fmt.Errorf("invalid -collectorintervals: the interval of %s has to be whole seconds, e.g. 30s",
+				statsType)
+		}
+		intervals[statsType] = duration
+	}
+	collectorIntervals = intervals
+	return nil
+}
+
+func findCollector(statsType string) *collectorState {
+	collectorsLock.Lock()
+	defer collectorsLock.Unlock()
+	for _, state := range collectors {
+		if state.collector.Describe().StatsType == statsType {
+			return state
+		}
+	}
+	return nil
+}
+
+// discoverDevices looks for the devices of all collectors, at startup and again with every reload. The
+// client collector goes first as it decides if this node is a client.
+func discoverDevices() {
+	collectorsLock.Lock()
+	defer collectorsLock.Unlock()
+	for _, state := range collectors {
+		if err := state.collector.Discover(); err != nil {
+			logError("discovering devices failed", "collector", state.collector.Describe().StatsType,
+				"error", err)
+		}
+	}
+}
+
+// collect runs the collectors which are due and publishes their rates. A collector without its own interval
+// runs with every sample, a collector which fails or panics doesn't affect the others.
+func collect(now time.Time) {
+	collectorsLock.Lock()
+	defer collectorsLock.Unlock()
+	collectedSeconds = make(map[string]uint64)
+	for _, state := range collectors {
+		var statsType = state.collector.Describe().StatsType
+		if !state.enabled() {
+			if state.prev != nil {
+				forgetJobs(statsType)
+			}
+			state.prev = nil
+			state.lastError = ""
+			publishCollection(statsType, collection{}, collection{})
+			continue
+		}
+		var own, scheduled = collectorIntervals[statsType]
+		if scheduled && !state.next.IsZero() && now.Add(time.Duration(interval)*time.Second/2).Before(state.next) {
+			continue
+		}
+		state.next = now.Add(own)
+		state.run(statsType, now)
+	}
+}
+
+func (s *collectorState) run(statsType string, now time.Time) {
+	var start = time.Now()
+	current, err := safeCollect(s.collector)
+	lureMetrics.set("collector."+statsType, "sample_duration_us", uint64(time.Since(start).Microseconds()))
+	if err != nil {
+		lureMetrics.add("collector."+statsType, "errors", 1)
+		logError("collector failed", "collector", statsType, "error", err)
+		s.lastError = err.Error()
+		publishCollection(statsType, collection{}, collection{})
+		return
+	}
+	s.lastError = ""
+	if s.collector.Describe().Jobs {
+		trackJobs(statsType, current.jobs, now)
+	}
+
+	var rates collection
+	if s.prev != nil {
+		var seconds = uint64(math.Round(now.Sub(s.prevTime).Seconds()))
+		if seconds < 1 {
+			seconds = 1
+		}
+		rates = collection{stats: calcStats(s.prev.stats, current.stats, seconds),
+			jobs: calcJobStats(s.prev.jobs, current.jobs, seconds)}
+		collectedSeconds[statsType] = seconds
+	}
+	publishCollection(statsType, rates, current)
+	s.prev = &current
+	s.prevTime = now
+}
+
+// collectedSecondsOf returns the seconds the current rates of a collector cover, false if it didn't calculate
+// new rates in the last sample, e.g. as it runs with its own -collectorintervals. Without collectors, e.g. in a
+// replay, the rates cover the interval.
+func collectedSecondsOf(statsType string) (uint64, bool) {
+	collectorsLock.Lock()
+	defer collectorsLock.Unlock()
+	if collectedSeconds == nil {
+		return uint64(interval), true
+	}
+	seconds, found := collectedSeconds[statsType]
+	return seconds, found
+}
+
+// safeCollect turns a panic of a collector into an error.
+func safeCollect(c Collector) (current collection, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("collector panicked: %v", r)
+		}
+	}()
+	return c.Collect()
+}
+
+// publishCollection makes the rates and totals of a collector the current stats of its type.
+func publishCollection(statsType string, rates collection, totals collection) {
+	if rates.stats == nil {
+		rates.stats = make(map[string]map[string]uint64)
+	}
+	if rates.jobs == nil {
+		rates.jobs = make(map[string]map[string]map[string]uint64)
+	}
+	if totals.stats == nil {
+		totals.stats = make(map[string]map[string]uint64)
+	}
+	if totals.jobs == nil {
+		totals.jobs = make(map[string]map[string]map[string]uint64)
+	}
+	switch statsType {
+	case "mdt":
+		mapMDTCalcStats, mapMDTTotalStats = rates.stats, totals.stats
+	case "ost":
+		mapOSTCalcStats, mapOSTTotalStats = rates.stats, totals.stats
+	case "client":
+		mapLliteCalcStats, mapLliteTotalStats = rates.stats, totals.stats
+	case "mdtjob":
+		mapMDTJobStats, mapMDTJobTotalStats = rates.jobs, totals.jobs
+	case "ostjob":
+		mapOSTJobStats, mapOSTJobTotalStats = rates.jobs, totals.jobs
+	}
+}
+
+// collectorStatuses describes the registered collectors for /api/v1/info.
+func collectorStatuses() []collectorStatus {
+	collectorsLock.Lock()
+	defer collectorsLock.Unlock()
+	var statuses = []collectorStatus{}
+	for _, state := range collectors {
+		var info = state.collector.Describe()
+		var seconds = interval
+		if own, scheduled := collectorIntervals[info.StatsType]; scheduled {
+			seconds = int(own / time.Second)
+		}
+		statuses = append(statuses, collectorStatus{collectorInfo: info, Enabled: state.enabled(),
+			Interval: seconds, Stale: staleDevicesOf(info.StatsType), LastError: state.lastError})
+	}
+	return statuses
+}
+
+// statsFileCollector reads a stats file per device directory, e.g. /proc/fs/lustre/obdfilter/*/stats.
+type statsFileCollector struct {
+	statsType   string
+	description string
+	dir         string
+	file        string
+	devices     *map[string]string
+}
+
+func (c statsFileCollector) Describe() collectorInfo {
+	return collectorInfo{StatsType: c.statsType, Description: c.description, Devices: len(*c.devices)}
+}
+
+// Discover finds the devices, a missing directory means there are none of this kind on the node.
+func (c statsFileCollector) Discover() error {
+	*c.devices = make(map[string]string)
+	files, err := ioutil.ReadDir(c.dir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, entry := range files {
+		if entry.IsDir() {
+			logInfo("found device", "type", c.statsType, "device", entry.Name())
+			(*c.devices)[entry.Name()] = c.dir + "/" + entry.Name() + "/" + c.file
+		}
+	}
+	if len(*c.devices) == 0 {
+		logInfo("no devices found", "type", c.statsType)
+	}
+	return nil
+}
+
+func (c statsFileCollector) CaptureFiles() (string, string, map[string]string) {
+	return c.statsType, c.file, *c.devices
+}
+
+func (c statsFileCollector) Collect() (collection, error) {
+	var raw = readStatsFile(*c.devices, c.statsType)
+	if len(raw) == 0 && len(*c.devices) > 0 {
+		return collection{}, fmt.Errorf("none of the %d stats files could be read", len(*c.devices))
+	}
+	return collection{stats: parseRAWSats(raw, c.statsType)}, nil
+}
+
+// lliteCollector reads the stats of the mounted filesystems. If there are any this node is a client.
+type lliteCollector struct {
+	statsFileCollector
+}
+
+func (c lliteCollector) Discover() error {
+	var err = c.statsFileCollector.Discover()
+	client = len(*c.devices) > 0
+	return err
+}
+
+// jobStatsCollector reads the job_stats of the devices found by the MDT or OST collector.
+type jobStatsCollector struct {
+	statsType  string
+	deviceType string
+	devices    *map[string]string
+}
+
+func (c jobStatsCollector) Describe() collectorInfo {
+	return collectorInfo{StatsType: c.statsType, Description: strings.ToUpper(c.statsType[:3]) + " jobstats",
+		Jobs: true, Devices: len(*c.devices)}
+}
+
+func (c jobStatsCollector) Discover() error {
+	return nil
+}
+
+// CaptureFiles keeps the job_stats next to the stats of the device, e.g. ost/testfs-OST0000/job_stats.
+func (c jobStatsCollector) CaptureFiles() (string, string, map[string]string) {
+	var files = make(map[string]string)
+	for device := range *c.devices {
+		files[device] = "/proc/fs/lustre/" + c.deviceType + "/" + device + "/job_stats"
+	}
+	return strings.TrimSuffix(c.statsType, "job"), "job_stats", files
+}
+
+func (c jobStatsCollector) Collect() (collection, error) {
+	var raw = readJobStatsFile(*c.devices, c.deviceType)
+	if len(raw) == 0 && len(*c.devices) > 0 {
+		return collection{}, fmt.Errorf("none of the %d job_stats files could be read", len(*c.devices))
+	}
+	return collection{jobs: parseRAWJobStats(raw, c.statsType)}, nil
+}
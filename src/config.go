@@ -0,0 +1,370 @@
+/*
+MIT License
+
+Copyright (c) 2020 storagebit.ch
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+var configFile string
+
+// commandLineFlags are the flags given on the command line, they override the configuration file also after a
+// reload.
+var commandLineFlags map[string]bool
+
+const defaultConfigFile = "/etc/lure/lure.yaml"
+
+// configKey maps a setting of the configuration file to the flag it sets. The file uses sections, e.g.
+// influxdb.server, the flags stay the single place where a setting is parsed and stored.
+type configKey struct {
+	path   string
+	flag   string
+	kind   string // "" for a plain value, "list" for a comma separated flag, "map" for key=value pairs
+	invert bool   // the flag disables what the setting enables, e.g. collectors.mdt and -ignoremdt
+	secret bool   // masked by lure config check
+}
+
+var configKeys = []configKey{
+	{path: "interval", flag: "interval"},
+	{path: "daemon", flag: "daemon"},
+	{path: "shutdown_timeout", flag: "shutdowntimeout"},
+	{path: "log.level", flag: "loglevel"},
+	{path: "log.format", flag: "logformat"},
+	{path: "log.repeat", flag: "logrepeat"},
+	{path: "collectors.mdt", flag: "ignoremdt", invert: true},
+	{path: "collectors.ost", flag: "ignoreost", invert: true},
+	{path: "collectors.jobstats", flag: "jobstats"},
+	{path: "collectors.intervals", flag: "collectorintervals", kind: "map"},
+	{path: "collectors.read_workers", flag: "readworkers"},
+	{path: "collectors.read_timeout", flag: "readtimeout"},
+	{path: "counters.mdt", flag: "mdtcounters", kind: "list"},
+	{path: "counters.ost", flag: "ostcounters", kind: "list"},
+	{path: "counters.client", flag: "clientcounters", kind: "list"},
+	{path: "counters.mdtjob", flag: "mdtjobcounters", kind: "list"},
+	{path: "counters.ostjob", flag: "ostjobcounters", kind: "list"},
+	{path: "jobs.top", flag: "topjobs"},
+	{path: "jobs.mode", flag: "jobmode"},
+	{path: "jobs.sort", flag: "jobsort"},
+	{path: "jobs.recent", flag: "recentjobs"},
+	{path: "jobs.retention", flag: "jobretention"},
+	{path: "jobs.id_pattern", flag: "jobidpattern"},
+	{path: "jobs.group", flag: "jobgroup"},
+	{path: "batch.enabled", flag: "batch"},
+	{path: "batch.format", flag: "batchformat"},
+	{path: "batch.count", flag: "count"},
+	{path: "http.enabled", flag: "nohttp", invert: true},
+	{path: "http.port", flag: "port"},
+	{path: "http.listen", flag: "listen", kind: "list"},
+	{path: "http.tlscert", flag: "tlscert"},
+	{path: "http.tlskey", flag: "tlskey"},
+	{path: "http.tlsclientca", flag: "tlsclientca"},
+	{path: "http.htpasswd", flag: "htpasswd"},
+	{path: "http.tokenfile", flag: "tokenfile"},
+	{path: "http.stream_buffer", flag: "streambuffer"},
+	{path: "http.stream_policy", flag: "streampolicy"},
+	{path: "http.stream_origins", flag: "streamorigins", kind: "list"},
+	{path: "history.tiers", flag: "history", kind: "list"},
+	{path: "history.maxmem", flag: "historymaxmem"},
+	{path: "record.dir", flag: "record"},
+	{path: "record.format", flag: "recordformat"},
+	{path: "record.maxsize", flag: "recordmaxsize"},
+	{path: "record.maxage", flag: "recordmaxage"},
+	{path: "record.retention", flag: "recordretention"},
+	{path: "influxdb.enabled", flag: "feedtoinflux"},
+	{path: "influxdb.server", flag: "influxserver"},
+	{path: "influxdb.port", flag: "influxport"},
+	{path: "influxdb.org", flag: "influxorg"},
+	{path: "influxdb.bucket", flag: "influxbucket"},
+	{path: "influxdb.token", flag: "influxtoken", secret: true},
+	{path: "statsd.enabled", flag: "feedtostatsd"},
+	{path: "statsd.address", flag: "statsdaddress"},
+	{path: "statsd.prefix", flag: "statsdprefix"},
+	{path: "statsd.type", flag: "statsdtype"},
+	{path: "statsd.tags", flag: "statsdtags"},
+	{path: "statsd.sample_rate", flag: "statsdsamplerate"},
+	{path: "otlp.enabled", flag: "feedtootlp"},
+	{path: "otlp.endpoint", flag: "otlpendpoint"},
+	{path: "otlp.protocol", flag: "otlpprotocol"},
+	{path: "otlp.insecure", flag: "otlpinsecure"},
+	{path: "otlp.headers", flag: "otlpheaders", kind: "map", secret: true},
+	{path: "otlp.batch_size", flag: "otlpbatchsize"},
+	{path: "otlp.flush_interval", flag: "otlpflushinterval"},
+	{path: "otlp.retries", flag: "otlpretries"},
+	{path: "otlp.retry_backoff", flag: "otlpretrybackoff"},
+	{path: "otlp.timeout", flag: "otlptimeout"},
+}
+
+// loadConfig reads a configuration file and sets every flag which wasn't given on the command line, settings
+// missing in the file get their default value. All problems of the file are reported at once, each with the
+// setting it belongs to.
+func loadConfig(file string, flags *flag.FlagSet) error {
+	if file == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	var settings yaml.MapSlice
+	if err := yaml.UnmarshalStrict(data, &settings); err != nil {
+		return fmt.Errorf("%s: %v", file, err)
+	}
+
+	if commandLineFlags == nil {
+		commandLineFlags = make(map[string]bool)
+		flags.Visit(func(f *flag.Flag) { commandLineFlags[f.Name] = true })
+	}
+	var fromCommandLine = commandLineFlags
+	for _, key := range configKeys {
+		if !fromCommandLine[key.flag] {
+			_ = flags.Set(key.flag, flags.Lookup(key.flag).DefValue)
+		}
+	}
+
+	var keys = make(map[string]configKey)
+	for _, key := range configKeys {
+		keys[key.path] = key
+	}
+	var problems []string
+	var walk func(prefix string, settings yaml.MapSlice)
+	walk = func(prefix string, settings yaml.MapSlice) {
+		for _, item := range settings {
+			var path = prefix + fmt.Sprint(item.Key)
+			key, known := keys[path]
+			if section, isSection := item.Value.(yaml.MapSlice); isSection && !known {
+				walk(path+".", section)
+				continue
+			}
+			if !known {
+				problems = append(problems, fmt.Sprintf("%s: unknown setting", path))
+				continue
+			}
+			value, err := configValue(key, item.Value)
+			if err == nil && !fromCommandLine[key.flag] && flags.Set(key.flag, value) != nil {
+				err = fmt.Errorf("invalid value %q, %s", value, expectedValue(flags.Lookup(key.flag)))
+			}
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("%s: %v", path, err))
+			}
+		}
+	}
+	walk("", settings)
+
+	if len(problems) > 0 {
+		return fmt.Errorf("%s:\n  %s", file, strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// configValue turns a value of the configuration file into the string the flag of a setting expects.
+func configValue(key configKey, value interface{}) (string, error) {
+	switch typed := value.(type) {
+	case nil:
+		return "", fmt.Errorf("missing value")
+	case []interface{}:
+		if key.kind != "list" {
+			return "", fmt.Errorf("a list is not allowed here")
+		}
+		var items []string
+		for _, item := range typed {
+			items = append(items, fmt.Sprint(item))
+		}
+		return strings.Join(items, ","), nil
+	case yaml.MapSlice:
+		if key.kind != "map" {
+			return "", fmt.Errorf("a section is not allowed here")
+		}
+		var pairs []string
+		for _, pair := range typed {
+			pairs = append(pairs, fmt.Sprintf("%v=%v", pair.Key, pair.Value))
+		}
+		return strings.Join(pairs, ","), nil
+	case bool:
+		if key.invert {
+			typed = !typed
+		}
+		return fmt.Sprint(typed), nil
+	}
+	if key.invert {
+		return "", fmt.Errorf("use true or false")
+	}
+	return fmt.Sprint(value), nil
+}
+
+// expectedValue describes the values a flag accepts.
+func expectedValue(f *flag.Flag) string {
+	switch f.Value.(flag.Getter).Get().(type) {
+	case bool:
+		return "use true or false"
+	case int, int64:
+		return "use a whole number"
+	case float64:
+		return "use a number"
+	case time.Duration:
+		return "use a duration like 30s, 5m or 24h"
+	}
+	return "see -" + f.Name
+}
+
+// effectiveConfig returns the configuration after merging file and flags, in the layout of the file.
+func effectiveConfig(flags *flag.FlagSet) yaml.MapSlice {
+	var config yaml.MapSlice
+	var sections = make(map[string]int)
+
+	for _, key := range configKeys {
+		var value interface{} = flags.Lookup(key.flag).Value.(flag.Getter).Get()
+		switch typed := value.(type) {
+		case bool:
+			if key.invert {
+				value = !typed
+			}
+		case time.Duration:
+			value = typed.String()
+		case string:
+			if key.secret && typed != "" {
+				value = "********"
+			}
+		}
+
+		var section, name, nested = strings.Cut(key.path, ".")
+		if !nested {
+			config = append(config, yaml.MapItem{Key: key.path, Value: value})
+			continue
+		}
+		index, found := sections[section]
+		if !found {
+			index = len(config)
+			sections[section] = index
+			config = append(config, yaml.MapItem{Key: section, Value: yaml.MapSlice{}})
+		}
+		config[index].Value = append(config[index].Value.(yaml.MapSlice), yaml.MapItem{Key: name, Value: value})
+	}
+	return config
+}
+
+// validateOptions checks all settings of the lure agent, no matter if they come from flags or the configuration
+// file.
+func validateOptions() error {
+	var problems []string
+	var check = func(err error) {
+		if err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+
+	if interval < 1 {
+		check(fmt.Errorf("the -interval must be at least one second"))
+	}
+	if statsdType != "gauge" && statsdType != "counter" {
+		check(fmt.Errorf("invalid StatsD metric type %q, use gauge or counter", statsdType))
+	}
+	if statsdSampleRate <= 0 || statsdSampleRate > 1 {
+		check(fmt.Errorf("invalid StatsD sample rate %v, use a value between 0 and 1", statsdSampleRate))
+	}
+	if otlpProtocol != "grpc" && otlpProtocol != "http/protobuf" {
+		check(fmt.Errorf("invalid OTLP protocol %q, use grpc or http/protobuf", otlpProtocol))
+	}
+	if otlpBatchSize < 1 || otlpFlushInterval <= 0 {
+		check(fmt.Errorf("the OTLP batch size and flush interval must be greater than zero"))
+	}
+	if _, err := parseHistoryTiers(historyTiers); err != nil {
+		check(fmt.Errorf("invalid -history: %v", err))
+	}
+	if err := setupCounters(); err != nil {
+		check(fmt.Errorf("invalid counter list %v", err))
+	} else if err := validateJobOptions(jobMode, jobSortBy); err != nil {
+		check(fmt.Errorf("invalid -jobmode or -jobsort: %v", err))
+	}
+	check(validateBatchOptions())
+	check(validateLogOptions())
+	check(setupCollectors())
+	check(validateReadOptions())
+	check(validateJobLifeOptions())
+	check(setupJobIDs())
+	if recordDir != "" {
+		check(validateRecordOptions())
+	}
+	if noHTTP != true {
+		check(validateHTTPOptions())
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("%s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// runConfig implements lure config check, which validates a configuration file and prints the effective
+// configuration, i.e. the file merged with the flags given on the command line.
+func runConfig(args []string) {
+	if len(args) == 0 || args[0] != "check" {
+		fmt.Fprintf(os.Stderr, "Usage: %s config check [options] [configuration file]\n", os.Args[0])
+		os.Exit(2)
+	}
+	var flags = flag.NewFlagSet("config check", flag.ExitOnError)
+	addMainFlags(flags)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s config check [options] [configuration file]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "The configuration file defaults to -config or %s, the options override it.\n", defaultConfigFile)
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(args[1:])
+
+	switch {
+	case flags.NArg() == 1:
+		configFile = flags.Arg(0)
+	case flags.NArg() > 1:
+		flags.Usage()
+		os.Exit(2)
+	case configFile == "":
+		configFile = defaultConfigFile
+	}
+
+	if err := loadConfig(configFile, flags); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	if err := validateOptions(); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	if noHTTP != true {
+		if err := httpSecurity.load(); err != nil {
+			log.Fatalf("Invalid configuration: %v", err)
+		}
+	}
+
+	data, err := yaml.Marshal(effectiveConfig(flags))
+	if err != nil {
+		log.Fatalf("Can't print the configuration: %v", err)
+	}
+	fmt.Printf("# %s is valid, effective configuration:\n%s", configFile, data)
+}
@@ -0,0 +1,157 @@
+/*
+MIT License
+
+Copyright (c) 2020 storagebit.ch
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// The counter lists decide which counters the console and web tables show and which are sent to InfluxDB, StatsD
+// and OpenTelemetry. The recordings, the stream and the REST API always carry every counter found in the stats
+// files. A list is either "default" for the built-in counters, "all" for whatever the stats files report, or a
+// comma separated list, where "default" can be extended, e.g. "default,samedir_rename,crossdir_rename".
+var counterFlags = map[string]*string{
+	"mdt": new(string), "ost": new(string), "client": new(string), "mdtjob": new(string), "ostjob": new(string),
+}
+
+// discoverCounters holds the stats types using "all", their lists are updated with every sample.
+var discoverCounters = make(map[string]bool)
+
+var defaultCounters = map[string][]string{
+	"mdt":    mdtCounters,
+	"ost":    ostCounters,
+	"client": lliteCounters,
+	"mdtjob": mdtJobStatsCounters,
+	"ostjob": ostJobStatsCounters,
+}
+
+// timeCounters are lines of the stats files which are timestamps and not counters.
+var timeCounters = map[string]bool{"snapshot_time": true, "start_time": true, "elapsed_time": true}
+
+// addCounterFlags registers the counter list flags on a flag set.
+func addCounterFlags(flags *flag.FlagSet) {
+	flags.StringVar(counterFlags["mdt"], "mdtcounters", "default", "MDT counters shown and exported, default, all or a comma separated list")
+	flags.StringVar(counterFlags["ost"], "ostcounters", "default", "OST counters shown and exported, default, all or a comma separated list")
+	flags.StringVar(counterFlags["client"], "clientcounters", "default", "Client counters shown and exported, default, all or a comma separated list")
+	flags.StringVar(counterFlags["mdtjob"], "mdtjobcounters", "default", "MDT jobstats counters shown and exported, default, all or a comma separated list")
+	flags.StringVar(counterFlags["ostjob"], "ostjobcounters", "default", "OST jobstats counters shown and exported, default, all or a comma separated list")
+}
+
+// counterList returns the package variable holding the counter list of a stats type.
+func counterList(statsType string) *[]string {
+	switch statsType {
+	case "mdt":
+		return &mdtCounters
+	case "ost":
+		return &ostCounters
+	case "client":
+		return &lliteCounters
+	case "mdtjob":
+		return &mdtJobStatsCounters
+	case "ostjob":
+		return &ostJobStatsCounters
+	}
+	return nil
+}
+
+// setupCounters applies the counter list flags.
+func setupCounters() error {
+	for _, statsType := range statsTypes {
+		counters, discover, err := parseCounterList(*counterFlags[statsType], defaultCounters[statsType])
+		if err != nil {
+			return fmt.Errorf("-%scounters: %v", statsType, err)
+		}
+		discoverCounters[statsType] = discover
+		*counterList(statsType) = counters
+	}
+	return nil
+}
+
+// parseCounterList expands a counter list flag. With "all" the list is empty until the first sample arrived.
+func parseCounterList(value string, defaults []string) ([]string, bool, error) {
+	value = strings.TrimSpace(value)
+	if value == "all" {
+		return nil, true, nil
+	}
+	var counters []string
+	var seen = make(map[string]bool)
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		var names = []string{name}
+		switch {
+		case name == "":
+			return nil, false, fmt.Errorf("empty counter name in %q", value)
+		case name == "all":
+			return nil, false, fmt.Errorf("all can't be combined with other counters")
+		case name == "default":
+			names = defaults
+		case timeCounters[name]:
+			return nil, false, fmt.Errorf("%s is a timestamp, not a counter", name)
+		}
+		for _, counter := range names {
+			if seen[counter] {
+				return nil, false, fmt.Errorf("counter %s is listed twice", counter)
+			}
+			seen[counter] = true
+			counters = append(counters, counter)
+		}
+	}
+	return counters, false, nil
+}
+
+// updateDiscoveredCounters sets the lists of the stats types using "all" to the counters found in a sample. The
+// built-in counters keep their usual order, the others follow sorted by name.
+func updateDiscoveredCounters(sample statsSample) {
+	for _, statsType := range statsTypes {
+		if !discoverCounters[statsType] {
+			continue
+		}
+		var found = make(map[string]bool)
+		for _, counters := range flatStats(sample, statsType) {
+			for counter := range counters {
+				if !timeCounters[counter] {
+					found[counter] = true
+				}
+			}
+		}
+
+		var counters []string
+		for _, counter := range defaultCounters[statsType] {
+			if found[counter] {
+				counters = append(counters, counter)
+				delete(found, counter)
+			}
+		}
+		var others []string
+		for counter := range found {
+			others = append(others, counter)
+		}
+		sort.Strings(others)
+		*counterList(statsType) = append(counters, others...)
+	}
+}
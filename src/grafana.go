@@ -0,0 +1,377 @@
+/*
+MIT License
+
+Copyright (c) 2020 storagebit.ch
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The Grafana "JSON API" / SimpleJSON datasource protocol, served under /grafana/. Metrics are named
+// <stats type>.<counter>, e.g. ost.write_bytes, with one time series per device, or per device and job.
+
+type grafanaRange struct {
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+}
+
+type grafanaFilter struct {
+	Key      string `json:"key"`
+	Operator string `json:"operator"`
+	Value    string `json:"value"`
+}
+
+type grafanaTarget struct {
+	Target  string          `json:"target"`
+	RefID   string          `json:"refId"`
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+type grafanaQuery struct {
+	Range         grafanaRange    `json:"range"`
+	IntervalMs    int64           `json:"intervalMs"`
+	MaxDataPoints int64           `json:"maxDataPoints"`
+	Targets       []grafanaTarget `json:"targets"`
+	AdhocFilters  []grafanaFilter `json:"adhocFilters"`
+}
+
+type grafanaSeries struct {
+	Target     string       `json:"target"`
+	Datapoints [][2]float64 `json:"datapoints"`
+}
+
+type grafanaColumn struct {
+	Text string `json:"text"`
+	Type string `json:"type"`
+}
+
+type grafanaTable struct {
+	Type    string          `json:"type"`
+	Columns []grafanaColumn `json:"columns"`
+	Rows    [][]interface{} `json:"rows"`
+}
+
+type grafanaAnnotation struct {
+	Time    int64    `json:"time"`
+	TimeEnd int64    `json:"timeEnd,omitempty"`
+	Title   string   `json:"title"`
+	Text    string   `json:"text"`
+	Tags    []string `json:"tags"`
+}
+
+func grafanaWrite(w http.ResponseWriter, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(data)
+}
+
+// grafanaRead decodes a POST body, Grafana always sends JSON.
+func grafanaRead(w http.ResponseWriter, r *http.Request, request interface{}) bool {
+	if r.Method != http.MethodPost {
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return false
+	}
+	if err := json.NewDecoder(r.Body).Decode(request); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// grafanaMetric splits a metric name into stats type and counter, any counter found in the stats files.
+func grafanaMetric(target string) (string, string, error) {
+	var statsType, counter, _ = strings.Cut(target, ".")
+	for _, known := range availableCounters(currentSample(), statsType) {
+		if known == counter {
+			return statsType, counter, nil
+		}
+	}
+	return "", "", fmt.Errorf("unknown metric %q, use <stats type>.<counter>, e.g. ost.write_bytes", target)
+}
+
+// grafanaStatsFilter combines the ad hoc filters of the dashboard and the payload of the query, e.g.
+// {"device": "*OST000[0-3]", "job": "dd.*"}. Payloads sent as a string are accepted as well.
+func grafanaStatsFilter(filters []grafanaFilter, payload json.RawMessage) (statsFilter, error) {
+	var filter statsFilter
+	for _, adhoc := range filters {
+		if adhoc.Operator != "=" {
+			return filter, fmt.Errorf("unsupported operator %q in the %s filter, only = is supported", adhoc.Operator,
+				adhoc.Key)
+		}
+		switch adhoc.Key {
+		case "server":
+			filter.server = adhoc.Value
+		case "device":
+			filter.device = adhoc.Value
+		case "job":
+			filter.job = adhoc.Value
+		default:
+			return filter, fmt.Errorf("unknown filter key %q, use server, device or job", adhoc.Key)
+		}
+	}
+
+	var fields struct {
+		Server string `json:"server"`
+		Device string `json:"device"`
+		Job    string `json:"job"`
+	}
+	var text string
+	if json.Unmarshal(payload, &text) == nil {
+		payload = json.RawMessage(text)
+	}
+	if len(payload) > 0 && string(payload) != "null" && strings.TrimSpace(string(payload)) != "" {
+		if err := json.Unmarshal(payload, &fields); err != nil {
+			return filter, fmt.Errorf("invalid payload: %v", err)
+		}
+	}
+	if fields.Server != "" {
+		filter.server = fields.Server
+	}
+	if fields.Device != "" {
+		filter.device = fields.Device
+	}
+	if fields.Job != "" {
+		filter.job = fields.Job
+	}
+	return filter, filter.validate()
+}
+
+// grafanaPoints returns the stats of a time range from the history. Without history the latest sample is all
+// there is.
+func grafanaPoints(statsType string, query grafanaQuery, filter statsFilter) []historyPoint {
+	var step = time.Duration(query.IntervalMs) * time.Millisecond
+	if query.MaxDataPoints > 0 {
+		if minimum := query.Range.To.Sub(query.Range.From) / time.Duration(query.MaxDataPoints); step < minimum {
+			step = minimum
+		}
+	}
+	var _, points = history.query(statsType, query.Range.From, query.Range.To, step, filter)
+	if len(points) == 0 && !sampleTime.Before(query.Range.From) && !sampleTime.After(query.Range.To) {
+		points = append(points, historyPoint{Time: sampleTime, Rows: statsRows(currentSample(), statsType, filter)})
+	}
+	return points
+}
+
+func grafanaRowName(row statsRow) string {
+	var name = row.Device
+	if row.Server != "" {
+		name = row.Server + "/" + name
+	}
+	if row.Job != "" {
+		name += " " + row.Job
+	}
+	return name
+}
+
+// grafanaTimeSeries turns the points into one series per device or per device and job.
+func grafanaTimeSeries(points []historyPoint, counter string) []grafanaSeries {
+	var series = []grafanaSeries{}
+	var index = make(map[string]int)
+	for _, point := range points {
+		var timestamp = float64(point.Time.UnixNano() / int64(time.Millisecond))
+		for _, row := range point.Rows {
+			var name = grafanaRowName(row) + " " + counter
+			i, found := index[name]
+			if !found {
+				i = len(series)
+				index[name] = i
+				series = append(series, grafanaSeries{Target: name, Datapoints: [][2]float64{}})
+			}
+			series[i].Datapoints = append(series[i].Datapoints, [2]float64{float64(row.Counters[counter]), timestamp})
+		}
+	}
+	sort.Slice(series, func(i, j int) bool { return series[i].Target < series[j].Target })
+	return series
+}
+
+// grafanaRoot answers the datasource test of Grafana.
+func grafanaRoot(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/grafana/" {
+		http.NotFound(w, r)
+		return
+	}
+	_, _ = fmt.Fprintln(w, "OK")
+}
+
+// grafanaSearch lists the metrics, optionally only those containing the target of the request.
+func grafanaSearch(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Target string `json:"target"`
+	}
+	if !grafanaRead(w, r, &request) {
+		return
+	}
+	var metrics = []string{}
+	var sample = currentSample()
+	for _, statsType := range statsTypes {
+		for _, counter := range availableCounters(sample, statsType) {
+			var metric = statsType + "." + counter
+			if strings.Contains(metric, request.Target) {
+				metrics = append(metrics, metric)
+			}
+		}
+	}
+	grafanaWrite(w, metrics)
+}
+
+// grafanaQueryHandler returns time series from the history, or for table panels the latest sample.
+func grafanaQueryHandler(w http.ResponseWriter, r *http.Request) {
+	var query grafanaQuery
+	if !grafanaRead(w, r, &query) {
+		return
+	}
+	var response = []interface{}{}
+	for _, target := range query.Targets {
+		if target.Target == "" {
+			continue
+		}
+		statsType, counter, err := grafanaMetric(target.Target)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		filter, err := grafanaStatsFilter(query.AdhocFilters, target.Payload)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if target.Type == "table" {
+			var table = grafanaTable{
+				Type:    "table",
+				Columns: []grafanaColumn{{"device", "string"}, {"job", "string"}, {counter, "number"}},
+				Rows:    [][]interface{}{},
+			}
+			for _, row := range statsRows(currentSample(), statsType, filter) {
+				table.Rows = append(table.Rows, []interface{}{row.Device, row.Job, row.Counters[counter]})
+			}
+			response = append(response, table)
+			continue
+		}
+		for _, series := range grafanaTimeSeries(grafanaPoints(statsType, query, filter), counter) {
+			response = append(response, series)
+		}
+	}
+	grafanaWrite(w, response)
+}
+
+// grafanaAnnotations marks the jobs which showed up in the jobstats during the time range. The annotation query
+// is an optional glob pattern for the job IDs.
+func grafanaAnnotations(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Range      grafanaRange `json:"range"`
+		Annotation struct {
+			Name  string `json:"name"`
+			Query string `json:"query"`
+		} `json:"annotation"`
+	}
+	if !grafanaRead(w, r, &request) {
+		return
+	}
+	var filter = statsFilter{job: request.Annotation.Query}
+	if err := filter.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var annotations = []grafanaAnnotation{}
+	for _, statsType := range []string{"mdtjob", "ostjob"} {
+		var _, points = history.query(statsType, request.Range.From, request.Range.To, 0, filter)
+		var previous = make(map[string]bool)
+		for i, point := range points {
+			var current = make(map[string]bool)
+			for _, row := range point.Rows {
+				current[row.Job] = true
+				if i > 0 && !previous[row.Job] {
+					annotations = append(annotations, grafanaAnnotation{
+						Time:  point.Time.UnixNano() / int64(time.Millisecond),
+						Title: "Job " + row.Job,
+						Text:  fmt.Sprintf("Job %s showed up in the %s", row.Job, statsType),
+						Tags:  []string{statsType, row.Job},
+					})
+				}
+			}
+			previous = current
+		}
+	}
+	sort.Slice(annotations, func(i, j int) bool { return annotations[i].Time < annotations[j].Time })
+	grafanaWrite(w, annotations)
+}
+
+// grafanaTagKeys lists the keys for ad hoc filters.
+func grafanaTagKeys(w http.ResponseWriter, r *http.Request) {
+	grafanaWrite(w, []grafanaColumn{{"server", "string"}, {"device", "string"}, {"job", "string"}})
+}
+
+// grafanaTagValues lists the devices or jobs of the latest sample.
+func grafanaTagValues(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Key string `json:"key"`
+	}
+	if !grafanaRead(w, r, &request) {
+		return
+	}
+	var values = make(map[string]bool)
+	var sample = currentSample()
+	for _, statsType := range statsTypes {
+		for _, row := range statsRows(sample, statsType, statsFilter{}) {
+			switch request.Key {
+			case "server":
+				if row.Server != "" {
+					values[row.Server] = true
+				}
+			case "device":
+				values[row.Device] = true
+			case "job":
+				if row.Job != "" {
+					values[row.Job] = true
+				}
+			}
+		}
+	}
+	var sorted = []string{}
+	for value := range values {
+		sorted = append(sorted, value)
+	}
+	sort.Strings(sorted)
+	var tagValues = []map[string]string{}
+	for _, value := range sorted {
+		tagValues = append(tagValues, map[string]string{"text": value})
+	}
+	grafanaWrite(w, tagValues)
+}
+
+func registerGrafanaHandlers() {
+	http.HandleFunc("/grafana/", grafanaRoot)
+	http.HandleFunc("/grafana/search", grafanaSearch)
+	http.HandleFunc("/grafana/query", grafanaQueryHandler)
+	http.HandleFunc("/grafana/annotations", grafanaAnnotations)
+	http.HandleFunc("/grafana/tag-keys", grafanaTagKeys)
+	http.HandleFunc("/grafana/tag-values", grafanaTagValues)
+}
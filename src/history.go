@@ -0,0 +1,550 @@
+/*
+MIT License
+
+Copyright (c) 2020 storagebit.ch
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	historyTiers  string
+	historyMaxMem int64
+
+	history statsHistory
+)
+
+// statsHistory keeps past samples in memory, separately for every stats type and in tiers of decreasing
+// resolution, e.g. every sample for 15 minutes, 10s averages for 6 hours and 1 minute averages for 7 days.
+type statsHistory struct {
+	sync.Mutex
+	tiers    map[string][]*historyTier
+	maxBytes int64
+}
+
+// historyTier is a ring buffer of the averages over one step. Job stats are stored with "device@@job" keys.
+type historyTier struct {
+	step      time.Duration
+	retention time.Duration
+	capacity  int
+	entries   []historyEntry
+	first     int
+	count     int
+	bytes     int64
+
+	// The bucket currently being averaged.
+	bucket  time.Time
+	sums    map[string]map[string]uint64
+	samples uint64
+}
+
+type historyEntry struct {
+	time  time.Time
+	stats map[string]map[string]uint64
+	bytes int64
+}
+
+// historyPoint is one point in time of an /api/v1/history response.
+type historyPoint struct {
+	Time time.Time  `json:"time"`
+	Rows []statsRow `json:"rows"`
+}
+
+func addHistoryFlags(flags *flag.FlagSet) {
+	flags.StringVar(&historyTiers, "history", "1s:15m,10s:6h,1m:7d",
+		"In-memory history tiers as step:retention, served via /api/v1/history. Empty to disable")
+	flags.Int64Var(&historyMaxMem, "historymaxmem", 256, "Memory the in-memory history may use in MB, 0 for no limit")
+}
+
+// parseHistoryDuration is time.ParseDuration with days, "7d", on top.
+func parseHistoryDuration(value string) (time.Duration, error) {
+	if strings.HasSuffix(value, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(value, "d"))
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q", value)
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(value)
+}
+
+// setup creates the tiers from the -history option, a comma separated list of step:retention.
+func (h *statsHistory) setup(tiers string, maxMem int64) error {
+	parsed, err := parseHistoryTiers(tiers)
+	if err != nil {
+		return err
+	}
+	h.Lock()
+	defer h.Unlock()
+
+	h.tiers = parsed
+	h.maxBytes = maxMem * 1024 * 1024
+	return nil
+}
+
+// resize changes the tiers at runtime. Tiers whose step is still configured keep their samples, trimmed to the
+// new retention, tiers with a new step start empty.
+func (h *statsHistory) resize(tiers string, maxMem int64) error {
+	parsed, err := parseHistoryTiers(tiers)
+	if err != nil {
+		return err
+	}
+	h.Lock()
+	defer h.Unlock()
+
+	for statsType, newTiers := range parsed {
+		for i, tier := range newTiers {
+			for _, old := range h.tiers[statsType] {
+				if old.step == tier.step {
+					old.retention = tier.retention
+					old.capacity = tier.capacity
+					old.trim()
+					newTiers[i] = old
+				}
+			}
+		}
+	}
+	h.tiers = parsed
+	h.maxBytes = maxMem * 1024 * 1024
+	return nil
+}
+
+// parseHistoryTiers parses -history into empty tiers for every stats type.
+func parseHistoryTiers(tiers string) (map[string][]*historyTier, error) {
+	var parsed = make(map[string][]*historyTier)
+	if tiers == "" {
+		return parsed, nil
+	}
+	for _, statsType := range statsTypes {
+		var previous time.Duration
+		for _, tier := range strings.Split(tiers, ",") {
+			var stepValue, retentionValue, found = strings.Cut(strings.TrimSpace(tier), ":")
+			if !found {
+				return nil, fmt.Errorf("invalid history tier %q, use step:retention, e.g. 10s:6h", tier)
+			}
+			step, err := parseHistoryDuration(stepValue)
+			if err != nil {
+				return nil, err
+			}
+			retention, err := parseHistoryDuration(retentionValue)
+			if err != nil {
+				return nil, err
+			}
+			if step < time.Second || retention < step || step <= previous {
+				return nil, fmt.Errorf("invalid history tier %q, the steps have to increase and be shorter than the retention",
+					tier)
+			}
+			previous = step
+			parsed[statsType] = append(parsed[statsType], &historyTier{
+				step:      step,
+				retention: retention,
+				capacity:  int(retention / step),
+			})
+		}
+	}
+	return parsed, nil
+}
+
+// flatStats returns the stats of one type of a sample, job stats with "device@@job" keys.
+func flatStats(sample statsSample, statsType string) map[string]map[string]uint64 {
+	var jobStats map[string]map[string]map[string]uint64
+	switch statsType {
+	case "mdt":
+		return sample.MDT
+	case "ost":
+		return sample.OST
+	case "client":
+		return sample.Client
+	case "mdtjob":
+		jobStats = sample.MDTJob
+	case "ostjob":
+		jobStats = sample.OSTJob
+	}
+	var stats = make(map[string]map[string]uint64)
+	for device, jobs := range jobStats {
+		for job, counters := range jobs {
+			stats[device+"@@"+job] = counters
+		}
+	}
+	return stats
+}
+
+// historySample turns stored stats back into a sample, so the API filters and rows apply to history as well.
+func historySample(stats map[string]map[string]uint64, statsType string) statsSample {
+	var sample statsSample
+	switch statsType {
+	case "mdt":
+		sample.MDT = stats
+	case "ost":
+		sample.OST = stats
+	case "client":
+		sample.Client = stats
+	case "mdtjob", "ostjob":
+		var jobStats = make(map[string]map[string]map[string]uint64)
+		for deviceJob, counters := range stats {
+			var device, job, _ = strings.Cut(deviceJob, "@@")
+			if jobStats[device] == nil {
+				jobStats[device] = make(map[string]map[string]uint64)
+			}
+			jobStats[device][job] = counters
+		}
+		sample.MDTJob = jobStats
+		sample.OSTJob = jobStats
+	}
+	return sample
+}
+
+// statsBytes estimates the memory used by stats, map overhead included.
+func statsBytes(stats map[string]map[string]uint64) int64 {
+	var bytes int64 = 48
+	for key, counters := range stats {
+		bytes += int64(len(key)) + 64
+		for counter := range counters {
+			bytes += int64(len(counter)) + 32
+		}
+	}
+	return bytes
+}
+
+// add accumulates a sample into the current bucket. The bucket is stored once the next sample falls into the
+// next one, samples are expected every sampleInterval.
+func (t *historyTier) add(at time.Time, sampleInterval time.Duration, stats map[string]map[string]uint64) {
+	var bucket = at.Truncate(t.step)
+	if t.samples > 0 && !bucket.Equal(t.bucket) {
+		t.flush()
+	}
+	if t.samples == 0 {
+		t.bucket = bucket
+		t.sums = make(map[string]map[string]uint64)
+	}
+	for key, counters := range stats {
+		if t.sums[key] == nil {
+			t.sums[key] = make(map[string]uint64)
+		}
+		for counter, value := range counters {
+			t.sums[key][counter] += value
+		}
+	}
+	t.samples++
+	if !at.Add(sampleInterval).Before(bucket.Add(t.step)) {
+		t.flush()
+	}
+}
+
+// flush stores the average of the current bucket, overwriting the oldest entry once the ring is full. The ring
+// only grows as needed, a long retention doesn't cost anything until it is used.
+func (t *historyTier) flush() {
+	for _, counters := range t.sums {
+		for counter, value := range counters {
+			counters[counter] = value / t.samples
+		}
+	}
+	var entry = historyEntry{time: t.bucket, stats: t.sums, bytes: statsBytes(t.sums)}
+	t.sums = nil
+	t.samples = 0
+
+	for t.count > 0 && t.count >= t.capacity {
+		t.dropOldest()
+	}
+	if t.count == len(t.entries) {
+		if t.first != 0 {
+			var entries = make([]historyEntry, 0, 2*t.count)
+			for i := 0; i < t.count; i++ {
+				entries = append(entries, t.entry(i))
+			}
+			t.entries = entries
+			t.first = 0
+		}
+		t.entries = append(t.entries, entry)
+	} else {
+		t.entries[(t.first+t.count)%len(t.entries)] = entry
+	}
+	t.count++
+	t.bytes += entry.bytes
+
+	for t.count > 0 && t.entries[t.first].time.Before(entry.time.Add(-t.retention)) {
+		t.dropOldest()
+	}
+}
+
+// trim drops the entries beyond the capacity and retention, e.g. after the tier was resized.
+func (t *historyTier) trim() {
+	for t.count > 0 && t.count > t.capacity {
+		t.dropOldest()
+	}
+	for t.count > 0 && t.entries[t.first].time.Before(t.entry(t.count-1).time.Add(-t.retention)) {
+		t.dropOldest()
+	}
+}
+
+func (t *historyTier) dropOldest() {
+	t.bytes -= t.entries[t.first].bytes
+	t.entries[t.first] = historyEntry{}
+	t.first = (t.first + 1) % len(t.entries)
+	t.count--
+}
+
+func (t *historyTier) entry(i int) historyEntry {
+	return t.entries[(t.first+i)%len(t.entries)]
+}
+
+// add stores a sample in all tiers. If the history uses more memory than allowed the oldest entries of the
+// biggest tiers are dropped.
+func (h *statsHistory) add(sample statsSample) {
+	h.Lock()
+	defer h.Unlock()
+
+	var sampleInterval = time.Duration(sample.Interval) * time.Second
+	for statsType, tiers := range h.tiers {
+		var stats = flatStats(sample, statsType)
+		if len(stats) == 0 {
+			continue
+		}
+		for _, tier := range tiers {
+			tier.add(sample.Time, sampleInterval, stats)
+		}
+	}
+
+	for h.maxBytes > 0 && h.bytes() > h.maxBytes {
+		var biggest *historyTier
+		for _, tiers := range h.tiers {
+			for _, tier := range tiers {
+				if tier.count > 0 && (biggest == nil || tier.bytes > biggest.bytes) {
+					biggest = tier
+				}
+			}
+		}
+		if biggest == nil {
+			break
+		}
+		biggest.dropOldest()
+	}
+}
+
+func (h *statsHistory) bytes() int64 {
+	var bytes int64
+	for _, tiers := range h.tiers {
+		for _, tier := range tiers {
+			bytes += tier.bytes
+		}
+	}
+	return bytes
+}
+
+// query returns the stats between from and to. It uses the finest tier which still reaches back to from, or a
+// coarser one if the requested step allows it. Steps longer than the tier's step are averaged.
+func (h *statsHistory) query(statsType string, from time.Time, to time.Time, step time.Duration,
+	filter statsFilter) (time.Duration, []historyPoint) {
+	h.Lock()
+	defer h.Unlock()
+
+	var tiers = h.tiers[statsType]
+	if len(tiers) == 0 {
+		return 0, []historyPoint{}
+	}
+	var tier *historyTier
+	for _, candidate := range tiers {
+		var covers = candidate.count > 0 && !candidate.entry(0).time.After(from)
+		if covers && (tier == nil || candidate.step <= step) {
+			tier = candidate
+		}
+	}
+	// Nothing reaches back that far, use what goes back furthest.
+	if tier == nil {
+		tier = tiers[0]
+		for _, candidate := range tiers {
+			if candidate.count > 0 && (tier.count == 0 || candidate.entry(0).time.Before(tier.entry(0).time)) {
+				tier = candidate
+			}
+		}
+	}
+	if step < tier.step {
+		step = tier.step
+	}
+
+	// Average the tier's entries into buckets of the requested step.
+	var points = []historyPoint{}
+	var bucket time.Time
+	var sums map[string]map[string]uint64
+	var entries uint64
+	var addPoint = func() {
+		if entries == 0 {
+			return
+		}
+		for _, counters := range sums {
+			for counter, value := range counters {
+				counters[counter] = value / entries
+			}
+		}
+		points = append(points, historyPoint{Time: bucket, Rows: statsRows(historySample(sums, statsType),
+			statsType, filter)})
+	}
+	for i := 0; i < tier.count; i++ {
+		var entry = tier.entry(i)
+		if !entry.time.Add(tier.step).After(from) || entry.time.After(to) {
+			continue
+		}
+		if entries == 0 || !entry.time.Truncate(step).Equal(bucket) {
+			addPoint()
+			bucket = entry.time.Truncate(step)
+			sums = make(map[string]map[string]uint64)
+			entries = 0
+		}
+		for key, counters := range entry.stats {
+			if sums[key] == nil {
+				sums[key] = make(map[string]uint64)
+			}
+			for counter, value := range counters {
+				sums[key][counter] += value
+			}
+		}
+		entries++
+	}
+	addPoint()
+	return step, points
+}
+
+// historyUsage describes one tier for /api/v1/history/usage.
+type historyUsage struct {
+	Stats     string     `json:"stats"`
+	Step      string     `json:"step"`
+	Retention string     `json:"retention"`
+	Capacity  int        `json:"capacity"`
+	Entries   int        `json:"entries"`
+	Bytes     int64      `json:"bytes"`
+	Oldest    *time.Time `json:"oldest,omitempty"`
+	Newest    *time.Time `json:"newest,omitempty"`
+}
+
+func (h *statsHistory) usage() []historyUsage {
+	h.Lock()
+	defer h.Unlock()
+
+	var usage = []historyUsage{}
+	for _, statsType := range statsTypes {
+		for _, tier := range h.tiers[statsType] {
+			var tierUsage = historyUsage{
+				Stats:     statsType,
+				Step:      tier.step.String(),
+				Retention: tier.retention.String(),
+				Capacity:  tier.capacity,
+				Entries:   tier.count,
+				Bytes:     tier.bytes,
+			}
+			if tier.count > 0 {
+				var oldest, newest = tier.entry(0).time, tier.entry(tier.count - 1).time
+				tierUsage.Oldest, tierUsage.Newest = &oldest, &newest
+			}
+			usage = append(usage, tierUsage)
+		}
+	}
+	return usage
+}
+
+// parseHistoryTime accepts RFC3339, "2006-01-02 15:04:05", unix seconds, "now" and times relative to now like
+// "-10m" or "now-10m".
+func parseHistoryTime(value string, now time.Time) (time.Time, error) {
+	if value == "now" {
+		return now, nil
+	}
+	if relative := strings.TrimPrefix(value, "now"); strings.HasPrefix(relative, "-") {
+		duration, err := parseHistoryDuration(relative[1:])
+		if err != nil {
+			return now, err
+		}
+		return now.Add(-duration), nil
+	}
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(seconds, 0), nil
+	}
+	return parseReplayTime(value)
+}
+
+// apiHistory serves /api/v1/history?stats=ost&from=-10m&to=now&step=10s plus the filters of /api/v1/stats.
+func apiHistory(w http.ResponseWriter, r *http.Request) {
+	var query = r.URL.Query()
+	var statsType = query.Get("stats")
+	if countersOf(statsType) == nil {
+		apiError(w, http.StatusBadRequest, "unknown stats type %q, use one of %s", statsType,
+			strings.Join(statsTypes, ", "))
+		return
+	}
+	filter, err := parseStatsFilter(query)
+	if err != nil {
+		apiError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+
+	var now = time.Now()
+	var from, to = now.Add(-15 * time.Minute), now
+	if value := query.Get("from"); value != "" {
+		if from, err = parseHistoryTime(value, now); err != nil {
+			apiError(w, http.StatusBadRequest, "invalid from %q", value)
+			return
+		}
+	}
+	if value := query.Get("to"); value != "" {
+		if to, err = parseHistoryTime(value, now); err != nil {
+			apiError(w, http.StatusBadRequest, "invalid to %q", value)
+			return
+		}
+	}
+	var step time.Duration
+	if value := query.Get("step"); value != "" {
+		if step, err = parseHistoryDuration(value); err != nil || step < 0 {
+			apiError(w, http.StatusBadRequest, "invalid step %q", value)
+			return
+		}
+	}
+
+	step, points := history.query(statsType, from, to, step, filter)
+	apiWrite(w, http.StatusOK, apiEnvelope{Timestamp: sampleTime, Interval: interval, Host: hostname,
+		Stats: statsType, Data: map[string]interface{}{
+			"from":   from,
+			"to":     to,
+			"step":   step.String(),
+			"points": points,
+		}})
+}
+
+// apiHistoryUsage serves /api/v1/history/usage, the fill level and memory usage of every history tier.
+func apiHistoryUsage(w http.ResponseWriter, r *http.Request) {
+	var usage = history.usage()
+	var total int64
+	for _, tier := range usage {
+		total += tier.Bytes
+	}
+	apiWrite(w, http.StatusOK, apiEnvelope{Timestamp: sampleTime, Interval: interval, Host: hostname,
+		Data: map[string]interface{}{
+			"bytes":     total,
+			"max_bytes": history.maxBytes,
+			"tiers":     usage,
+		}})
+}
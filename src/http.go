@@ -0,0 +1,418 @@
+/*
+MIT License
+
+Copyright (c) 2020 storagebit.ch
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"embed"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// The web dashboard, plain HTML and JavaScript without any external dependencies so it works without internet
+// access.
+//
+//go:embed web
+var webFiles embed.FS
+
+var (
+	httpPort      int
+	httpListen    string
+	noHTTP        bool
+	httpTLSCert   string
+	httpTLSKey    string
+	httpClientCA  string
+	httpHtpasswd  string
+	httpTokenFile string
+
+	httpSecurity webSecurity
+	httpStarted  bool
+)
+
+// webSecurity holds the certificate and credentials of the web interface. Everything is read from files which
+// are read again on SIGHUP, e.g. after a certificate has been renewed.
+type webSecurity struct {
+	sync.RWMutex
+	certificate *tls.Certificate
+	clientCAs   *x509.CertPool
+	users       map[string]string
+	tokens      [][]byte
+	// Successfully verified passwords, bcrypt is slow by design and every request would pay for it.
+	verified map[string][32]byte
+}
+
+// addHTTPFlags registers the web interface options, they are shared by the live and the replay mode.
+func addHTTPFlags(flags *flag.FlagSet) {
+	flags.IntVar(&httpPort, "port", 8666, "HTTP port used to access the the stats via web browser.")
+	flags.StringVar(&httpListen, "listen", "",
+		"Comma separated HTTP listen addresses as host:port, [ipv6]:port or unix socket path. (default \"localhost:<port>\")")
+	flags.BoolVar(&noHTTP, "nohttp", false, "Disable the web interface.")
+	flags.StringVar(&httpTLSCert, "tlscert", "", "Certificate file to serve the web interface via HTTPS")
+	flags.StringVar(&httpTLSKey, "tlskey", "", "Private key file for the -tlscert certificate")
+	flags.StringVar(&httpClientCA, "tlsclientca", "",
+		"CA certificate file, only clients with a certificate signed by this CA are accepted (mTLS)")
+	flags.StringVar(&httpHtpasswd, "htpasswd", "",
+		"htpasswd file with the users allowed to access the web interface, bcrypt, apr1 and SHA hashes are supported")
+	flags.StringVar(&httpTokenFile, "tokenfile", "",
+		"File with bearer tokens allowed to access the web interface, one token per line")
+	addStreamFlags(flags)
+}
+
+// listenAddresses splits the -listen option, without it lure keeps listening on localhost and the -port.
+func listenAddresses(listen string, httpPort int) []string {
+	if listen == "" {
+		return []string{"localhost:" + strconv.Itoa(httpPort)}
+	}
+	var addresses []string
+	for _, address := range strings.Split(listen, ",") {
+		if address = strings.TrimSpace(address); address != "" {
+			addresses = append(addresses, address)
+		}
+	}
+	return addresses
+}
+
+// listen opens the listener for a single address. Addresses starting with a / or unix: are unix socket paths,
+// a stale socket file left behind by a previous run is removed first.
+func listen(address string) (net.Listener, error) {
+	if strings.HasPrefix(address, "/") || strings.HasPrefix(address, "unix:") {
+		var socket = strings.TrimPrefix(address, "unix:")
+		if info, err := os.Stat(socket); err == nil && info.Mode()&os.ModeSocket != 0 {
+			_ = os.Remove(socket)
+		}
+		return net.Listen("unix", socket)
+	}
+	return net.Listen("tcp", address)
+}
+
+// load reads all configured certificate and credential files. The current state is only replaced if all files
+// could be read, a broken file on reload keeps the web interface running with the previous settings.
+func (s *webSecurity) load() error {
+	var certificate *tls.Certificate
+	var clientCAs *x509.CertPool
+	var users map[string]string
+	var tokens [][]byte
+
+	if httpTLSCert != "" {
+		cert, err := tls.LoadX509KeyPair(httpTLSCert, httpTLSKey)
+		if err != nil {
+			return err
+		}
+		certificate = &cert
+	}
+	if httpClientCA != "" {
+		pem, err := ioutil.ReadFile(httpClientCA)
+		if err != nil {
+			return err
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("%s: no PEM encoded certificates found", httpClientCA)
+		}
+	}
+	if httpHtpasswd != "" {
+		data, err := ioutil.ReadFile(httpHtpasswd)
+		if err != nil {
+			return err
+		}
+		users = make(map[string]string)
+		for i, line := range strings.Split(string(data), "\n") {
+			if line = strings.TrimSpace(line); line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			user, hash, found := strings.Cut(line, ":")
+			if !found {
+				return fmt.Errorf("%s:%d: expected user:hash", httpHtpasswd, i+1)
+			}
+			users[user] = hash
+		}
+	}
+	if httpTokenFile != "" {
+		data, err := ioutil.ReadFile(httpTokenFile)
+		if err != nil {
+			return err
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+				tokens = append(tokens, []byte(line))
+			}
+		}
+		if len(tokens) == 0 {
+			return fmt.Errorf("%s: no tokens found", httpTokenFile)
+		}
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	s.certificate = certificate
+	s.clientCAs = clientCAs
+	s.users = users
+	s.tokens = tokens
+	s.verified = make(map[string][32]byte)
+	return nil
+}
+
+// tlsConfig returns the TLS configuration used by all listeners. It is evaluated per connection, so reloaded
+// certificates are picked up without restarting the listeners.
+func (s *webSecurity) tlsConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			s.RLock()
+			defer s.RUnlock()
+			if s.certificate == nil {
+				return nil, fmt.Errorf("no certificate loaded, -tlscert is not set")
+			}
+			var config = &tls.Config{MinVersion: tls.VersionTLS12, Certificates: []tls.Certificate{*s.certificate}}
+			if s.clientCAs != nil {
+				config.ClientCAs = s.clientCAs
+				config.ClientAuth = tls.RequireAndVerifyClientCert
+			}
+			return config, nil
+		},
+	}
+}
+
+// checkPassword verifies a password against a htpasswd hash.
+func checkPassword(hash string, password string) bool {
+	switch {
+	case strings.HasPrefix(hash, "$2y$"), strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"):
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	case strings.HasPrefix(hash, "$apr1$"):
+		var parts = strings.SplitN(hash, "$", 4)
+		if len(parts) != 4 {
+			return false
+		}
+		return subtle.ConstantTimeCompare([]byte(hash), []byte(apr1Crypt(password, parts[2]))) == 1
+	case strings.HasPrefix(hash, "{SHA}"):
+		var sum = sha1.Sum([]byte(password))
+		return subtle.ConstantTimeCompare([]byte(hash[5:]), []byte(base64.StdEncoding.EncodeToString(sum[:]))) == 1
+	}
+	return false
+}
+
+// apr1Crypt is the Apache variant of the MD5 based crypt, the default of the htpasswd tool.
+func apr1Crypt(password string, salt string) string {
+	const itoa64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	const magic = "$apr1$"
+
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+
+	var alternate = md5.Sum([]byte(password + salt + password))
+	var ctx = []byte(password + magic + salt)
+	for i := len(password); i > 0; i -= 16 {
+		if i > 16 {
+			ctx = append(ctx, alternate[:]...)
+		} else {
+			ctx = append(ctx, alternate[:i]...)
+		}
+	}
+	for i := len(password); i > 0; i >>= 1 {
+		if i&1 == 1 {
+			ctx = append(ctx, 0)
+		} else {
+			ctx = append(ctx, password[0])
+		}
+	}
+	var final = md5.Sum(ctx)
+
+	for i := 0; i < 1000; i++ {
+		var round []byte
+		if i&1 == 1 {
+			round = append(round, password...)
+		} else {
+			round = append(round, final[:]...)
+		}
+		if i%3 != 0 {
+			round = append(round, salt...)
+		}
+		if i%7 != 0 {
+			round = append(round, password...)
+		}
+		if i&1 == 1 {
+			round = append(round, final[:]...)
+		} else {
+			round = append(round, password...)
+		}
+		final = md5.Sum(round)
+	}
+
+	var result = []byte(magic + salt + "$")
+	encode := func(a, b, c byte, n int) {
+		var v = uint(a)<<16 | uint(b)<<8 | uint(c)
+		for ; n > 0; n-- {
+			result = append(result, itoa64[v&0x3f])
+			v >>= 6
+		}
+	}
+	encode(final[0], final[6], final[12], 4)
+	encode(final[1], final[7], final[13], 4)
+	encode(final[2], final[8], final[14], 4)
+	encode(final[3], final[9], final[15], 4)
+	encode(final[4], final[10], final[5], 4)
+	encode(0, 0, final[11], 2)
+	return string(result)
+}
+
+// authorized checks the basic auth credentials or bearer token of a request.
+func (s *webSecurity) authorized(r *http.Request) bool {
+	s.RLock()
+	var users, tokens = s.users, s.tokens
+	s.RUnlock()
+
+	if users == nil && tokens == nil {
+		return true
+	}
+
+	if user, password, ok := r.BasicAuth(); ok && users != nil {
+		hash, found := users[user]
+		if !found {
+			return false
+		}
+		var digest = sha256.Sum256([]byte(hash + ":" + password))
+		s.RLock()
+		cached, found := s.verified[user]
+		s.RUnlock()
+		if found && cached == digest {
+			return true
+		}
+		if checkPassword(hash, password) {
+			s.Lock()
+			s.verified[user] = digest
+			s.Unlock()
+			return true
+		}
+		return false
+	}
+
+	if token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "); token != r.Header.Get("Authorization") {
+		for _, allowed := range tokens {
+			if subtle.ConstantTimeCompare([]byte(token), allowed) == 1 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// authHandler protects all handlers of the web interface.
+func (s *webSecurity) authHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.authorized(r) {
+			if httpHtpasswd != "" {
+				w.Header().Add("WWW-Authenticate", `Basic realm="lure", charset="UTF-8"`)
+			}
+			if httpTokenFile != "" {
+				w.Header().Add("WWW-Authenticate", `Bearer realm="lure"`)
+			}
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// validateHTTPOptions checks the web interface flags which can be checked without reading any files.
+func validateHTTPOptions() error {
+	if (httpTLSCert == "") != (httpTLSKey == "") {
+		return fmt.Errorf("both -tlscert and -tlskey are required for HTTPS")
+	}
+	if httpClientCA != "" && httpTLSCert == "" {
+		return fmt.Errorf("client certificate verification with -tlsclientca requires HTTPS, use -tlscert and -tlskey")
+	}
+	if streamBuffer < 1 {
+		return fmt.Errorf("the -streambuffer must hold at least one sample")
+	}
+	if _, err := newStreamSubscriber(nil); err != nil {
+		return fmt.Errorf("invalid -streampolicy: %v", err)
+	}
+	return nil
+}
+
+// startHTTPServer serves the web and JSON interface in the background on all addresses. Failing to bind one of
+// the addresses is fatal, nobody would notice a web interface silently missing otherwise.
+func startHTTPServer(addresses []string) {
+	if err := validateHTTPOptions(); err != nil {
+		logFatal("can't start the web interface", "error", err)
+	}
+	if err := httpSecurity.load(); err != nil {
+		logFatal("can't start the web interface", "error", err)
+	}
+	httpStarted = true
+	startReloadHandler()
+
+	http.HandleFunc("/stats", httpStats)
+	http.HandleFunc("/json", jsonStats)
+	http.HandleFunc("/stream", httpStream)
+	registerAPIHandlers()
+	registerGrafanaHandlers()
+
+	dashboard, _ := fs.Sub(webFiles, "web")
+	http.Handle("/", http.FileServer(http.FS(dashboard)))
+
+	var scheme = "http"
+	if httpTLSCert != "" {
+		scheme = "https"
+	}
+	var handler = countRequests(httpSecurity.authHandler(http.DefaultServeMux))
+
+	for _, address := range addresses {
+		listener, err := listen(address)
+		if err != nil {
+			logFatal("can't start the web interface", "address", address, "error", err)
+		}
+		if httpTLSCert != "" {
+			listener = tls.NewListener(listener, httpSecurity.tlsConfig())
+		}
+		logInfo("web interface listening", "url", scheme+"://"+listener.Addr().String(), "network",
+			listener.Addr().Network())
+
+		var server = &http.Server{Handler: handler}
+		httpServers = append(httpServers, server)
+		go func() {
+			if err := server.Serve(listener); err != http.ErrServerClosed {
+				checkContinue(err)
+			}
+		}()
+	}
+}
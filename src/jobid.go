@@ -0,0 +1,286 @@
+/*
+MIT License
+
+Copyright (c) 2020 storagebit.ch
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os/user"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Lustre builds the job IDs from jobid_var and jobid_name, e.g. jobid_var=procname_uid gives dd.1001 and
+// jobid_name=%e.%u.%H gives dd.1001.node12. lure splits them up again to group the jobs by user, executable
+// or node.
+
+var (
+	jobIDPattern string
+	jobGroup     string
+
+	jobIDPatterns []*regexp.Regexp
+	jobIDCache    = make(map[string]*jobID)
+	jobIDLock     sync.Mutex
+	userNames     = make(map[string]string)
+	// UIDs being looked up, userNames holds the UID itself until the lookup is done.
+	userNamesPending = make(map[string]bool)
+)
+
+// jobIDFields are the jobid_name format codes, see lctl set_param jobid_name. %p is matched but not kept.
+var jobIDFields = map[byte]string{
+	'e': `(?P<executable>.+?)`,
+	'u': `(?P<uid>\d+)`,
+	'g': `(?P<gid>\d+)`,
+	'h': `(?P<hostname>.+?)`,
+	'H': `(?P<hostname>[^.]+)`,
+	'j': `(?P<job>.+?)`,
+	'p': `\d+`,
+}
+
+var jobGroups = []string{"user", "executable", "node"}
+
+// jobID is a job ID split into its parts, parts not in the format are empty.
+type jobID struct {
+	Executable string `json:"executable,omitempty"`
+	UID        string `json:"uid,omitempty"`
+	User       string `json:"user,omitempty"`
+	GID        string `json:"gid,omitempty"`
+	Hostname   string `json:"hostname,omitempty"`
+	Job        string `json:"job,omitempty"`
+}
+
+func addJobIDFlags(flags *flag.FlagSet) {
+	flags.StringVar(&jobIDPattern, "jobidpattern", "auto",
+		"Comma separated job ID formats like jobid_name, e.g. %e.%u.%H, auto uses the server's jobid_var and "+
+			"jobid_name, none disables")
+	flags.StringVar(&jobGroup, "jobgroup", "", "Sum the jobs up by user, executable or node in the console")
+}
+
+// setupJobIDs compiles -jobidpattern.
+func setupJobIDs() error {
+	var patterns = jobIDPattern
+	switch jobIDPattern {
+	case "auto":
+		patterns = serverJobIDPatterns()
+	case "none":
+		patterns = ""
+	}
+	var compiled []*regexp.Regexp
+	for _, pattern := range strings.Split(patterns, ",") {
+		if strings.TrimSpace(pattern) == "" {
+			continue
+		}
+		regex, err := compileJobIDPattern(strings.TrimSpace(pattern))
+		if err != nil {
+			return fmt.Errorf("invalid -jobidpattern: %v", err)
+		}
+		compiled = append(compiled, regex)
+	}
+	if jobGroup != "" && !knownJobGroup(jobGroup) {
+		return fmt.Errorf("unknown -jobgroup %q, use user, executable or node", jobGroup)
+	}
+
+	jobIDLock.Lock()
+	defer jobIDLock.Unlock()
+	jobIDPatterns = compiled
+	jobIDCache = make(map[string]*jobID)
+	return nil
+}
+
+func knownJobGroup(group string) bool {
+	for _, known := range jobGroups {
+		if known == group {
+			return true
+		}
+	}
+	return false
+}
+
+// serverJobIDPatterns derives the job ID formats from the Lustre settings. With a scheduler variable like
+// SLURM_JOB_ID processes without it get a job ID built from jobid_name, so both are tried.
+func serverJobIDPatterns() string {
+	var jobIDVar = lustreParameter("jobid_var")
+	var jobIDName = lustreParameter("jobid_name")
+	switch jobIDVar {
+	case "", "disable", "session":
+		return ""
+	case "procname_uid":
+		return "%e.%u"
+	case "nodelocal":
+		return jobIDName
+	}
+	if jobIDName == "" {
+		return "%j"
+	}
+	return jobIDName + ",%j"
+}
+
+// lustreParameter reads a global Lustre parameter, empty if it isn't set or lure doesn't run on a Lustre node.
+func lustreParameter(name string) string {
+	for _, dir := range []string{"/sys/fs/lustre/", "/proc/fs/lustre/"} {
+		if value, err := ioutil.ReadFile(dir + name); err == nil {
+			return strings.TrimSpace(string(value))
+		}
+	}
+	return ""
+}
+
+// compileJobIDPattern turns a jobid_name format into a regular expression matching the whole job ID.
+func compileJobIDPattern(pattern string) (*regexp.Regexp, error) {
+	var expression = "^"
+	for i := 0; i < len(pattern); i++ {
+		if pattern[i] != '%' {
+			expression += regexp.QuoteMeta(pattern[i : i+1])
+			continue
+		}
+		if i+1 == len(pattern) {
+			return nil, fmt.Errorf("%q ends with %%", pattern)
+		}
+		i++
+		if pattern[i] == '%' {
+			expression += "%"
+		} else if field, found := jobIDFields[pattern[i]]; found {
+			expression += field
+		} else {
+			return nil, fmt.Errorf("unknown format %%%c in %q, use %%e, %%u, %%g, %%h, %%H, %%j or %%p", pattern[i],
+				pattern)
+		}
+	}
+	return regexp.Compile(expression + "$")
+}
+
+// parseJobID splits a job ID with the first -jobidpattern matching it, nil if none does.
+func parseJobID(job string) *jobID {
+	jobIDLock.Lock()
+	if parsed, found := jobIDCache[job]; found {
+		jobIDLock.Unlock()
+		return parsed
+	}
+	var patterns = jobIDPatterns
+	jobIDLock.Unlock()
+
+	var parsed *jobID
+	var resolved = true
+	for _, regex := range patterns {
+		var match = regex.FindStringSubmatch(job)
+		if match == nil {
+			continue
+		}
+		parsed = &jobID{}
+		for i, name := range regex.SubexpNames() {
+			switch name {
+			case "executable":
+				parsed.Executable = match[i]
+			case "uid":
+				parsed.UID = match[i]
+				parsed.User, resolved = userName(match[i])
+			case "gid":
+				parsed.GID = match[i]
+			case "hostname":
+				parsed.Hostname = match[i]
+			case "job":
+				parsed.Job = match[i]
+			}
+		}
+		break
+	}
+
+	// A job parsed while its user is still looked up is parsed again next time.
+	if resolved {
+		jobIDLock.Lock()
+		if len(jobIDCache) >= 100000 {
+			jobIDCache = make(map[string]*jobID)
+		}
+		jobIDCache[job] = parsed
+		jobIDLock.Unlock()
+	}
+	return parsed
+}
+
+// userName looks up the name of a UID, the UID itself if it is unknown on this node. The lookup may ask a
+// directory service and is done without jobIDLock, other callers get the UID until it is done and false.
+func userName(uid string) (string, bool) {
+	jobIDLock.Lock()
+	if name, found := userNames[uid]; found {
+		var pending = userNamesPending[uid]
+		jobIDLock.Unlock()
+		return name, !pending
+	}
+	userNames[uid] = uid
+	userNamesPending[uid] = true
+	jobIDLock.Unlock()
+
+	var name = uid
+	if account, err := user.LookupId(uid); err == nil {
+		name = account.Username
+	}
+	jobIDLock.Lock()
+	userNames[uid] = name
+	delete(userNamesPending, uid)
+	jobIDLock.Unlock()
+	return name, true
+}
+
+// jobGroupOf returns what a job is summed up by for a -jobgroup, unknown if its ID doesn't have that part.
+func jobGroupOf(job string, group string) string {
+	var value string
+	if parsed := parseJobID(job); parsed != nil {
+		switch group {
+		case "user":
+			value = parsed.User
+		case "executable":
+			value = parsed.Executable
+		case "node":
+			value = parsed.Hostname
+		}
+	}
+	if value == "" {
+		return "unknown"
+	}
+	return value
+}
+
+// influxJobTags returns the parts of a job ID as additional InfluxDB tags, e.g. ",executable=dd,user=alice".
+func influxJobTags(job string) string {
+	var parsed = parseJobID(job)
+	if parsed == nil {
+		return ""
+	}
+	var tags string
+	for _, tag := range [][2]string{{"executable", parsed.Executable}, {"uid", parsed.UID},
+		{"user", parsed.User}, {"gid", parsed.GID}, {"hostname", parsed.Hostname}, {"jobid", parsed.Job}} {
+		if tag[1] != "" {
+			tags += "," + tag[0] + "=" + influxEscapeTag(tag[1])
+		}
+	}
+	return tags
+}
+
+// influxEscapeTag escapes the characters line protocol doesn't allow in tag values.
+func influxEscapeTag(value string) string {
+	return strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `).Replace(value)
+}
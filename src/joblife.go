@@ -0,0 +1,272 @@
+/*
+MIT License
+
+Copyright (c) 2020 storagebit.ch
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	tm "github.com/buger/goterm"
+	"github.com/dustin/go-humanize"
+)
+
+// Lustre removes a job from job_stats once it was idle for job_cleanup_interval. lure keeps the jobs it saw
+// with their totals since they were first seen for -jobretention, so short jobs and jobs Lustre already
+// forgot about still show up.
+
+var (
+	jobRetention time.Duration
+	recentJobs   int
+
+	jobLives     = make(map[jobLifeKey]*jobLife)
+	jobLivesLock sync.Mutex
+)
+
+type jobLifeKey struct {
+	statsType string
+	device    string
+	job       string
+}
+
+// jobLife is a job on one target.
+type jobLife struct {
+	firstSeen time.Time
+	lastSeen  time.Time
+	expired   bool
+	last      map[string]uint64 // the counters of job_stats when the job was last seen
+	totals    map[string]uint64 // the counters since the job was first seen
+}
+
+// recentJob is a job summed over its targets, for /api/v1/jobs/recent and -recentjobs.
+type recentJob struct {
+	Job       string            `json:"job"`
+	State     string            `json:"state"`
+	FirstSeen time.Time         `json:"first_seen"`
+	LastSeen  time.Time         `json:"last_seen"`
+	Targets   int               `json:"targets"`
+	Bytes     uint64            `json:"bytes"`
+	Ops       uint64            `json:"ops"`
+	Totals    map[string]uint64 `json:"totals"`
+}
+
+func addJobLifeFlags(flags *flag.FlagSet) {
+	flags.DurationVar(&jobRetention, "jobretention", time.Hour,
+		"Time jobs are kept in the recent jobs after they disappeared from job_stats")
+	flags.IntVar(&recentJobs, "recentjobs", 0,
+		"Show the N most recently seen jobs with their totals in the console, 0 to disable")
+}
+
+func validateJobLifeOptions() error {
+	if jobRetention <= 0 {
+		return fmt.Errorf("the -jobretention must be greater than zero")
+	}
+	if recentJobs < 0 {
+		return fmt.Errorf("the -recentjobs can't be negative")
+	}
+	return nil
+}
+
+// trackJobs updates the jobs of a job stats collector with the counters it just read. Jobs of devices which
+// weren't read, e.g. stale ones, are left alone. A job which is gone from a device it was read from expired.
+func trackJobs(statsType string, current map[string]map[string]map[string]uint64, now time.Time) {
+	jobLivesLock.Lock()
+	defer jobLivesLock.Unlock()
+
+	for device, jobs := range current {
+		for job, counters := range jobs {
+			var key = jobLifeKey{statsType, device, job}
+			var life = jobLives[key]
+			if life == nil {
+				life = &jobLife{firstSeen: now, totals: make(map[string]uint64)}
+				jobLives[key] = life
+			}
+			for counter, value := range counters {
+				var previous = life.last[counter]
+				if life.expired || value < previous {
+					// Lustre cleaned the job up in between and started counting from zero again.
+					previous = 0
+				}
+				life.totals[counter] += value - previous
+			}
+			life.last = counters
+			life.lastSeen = now
+			life.expired = false
+		}
+	}
+
+	for key, life := range jobLives {
+		if key.statsType != statsType {
+			continue
+		}
+		if _, read := current[key.device]; read && current[key.device][key.job] == nil {
+			life.expired = true
+		}
+		if life.expired && now.Sub(life.lastSeen) > jobRetention {
+			delete(jobLives, key)
+		}
+	}
+}
+
+// forgetJobs drops the jobs of a job stats type, e.g. when its collector was disabled.
+func forgetJobs(statsType string) {
+	jobLivesLock.Lock()
+	defer jobLivesLock.Unlock()
+	for key := range jobLives {
+		if key.statsType == statsType {
+			delete(jobLives, key)
+		}
+	}
+}
+
+// recentJobList sums the tracked jobs of a job mode per job, filtered by device, job and state. They are
+// sorted by a counter, bytes or ops, highest first, or by default the most recently seen first.
+func recentJobList(mode string, filter statsFilter, state string, sortBy string, top int) []recentJob {
+	jobLivesLock.Lock()
+	var summed = make(map[string]*recentJob)
+	for _, statsType := range jobStatsTypes(mode) {
+		for key, life := range jobLives {
+			if key.statsType != statsType || !filter.matchDevice(key.device) || !matches(filter.job, key.job) {
+				continue
+			}
+			var job = summed[key.job]
+			if job == nil {
+				job = &recentJob{Job: key.job, State: "expired", FirstSeen: life.firstSeen,
+					Totals: make(map[string]uint64)}
+				summed[key.job] = job
+			}
+			job.Targets++
+			if !life.expired {
+				job.State = "active"
+			}
+			if life.firstSeen.Before(job.FirstSeen) {
+				job.FirstSeen = life.firstSeen
+			}
+			if life.lastSeen.After(job.LastSeen) {
+				job.LastSeen = life.lastSeen
+			}
+			for counter, value := range life.totals {
+				job.Totals[counter] += value
+				if strings.Contains(counter, "bytes") {
+					job.Bytes += value
+				} else {
+					job.Ops += value
+				}
+			}
+		}
+	}
+	jobLivesLock.Unlock()
+
+	var jobs = []recentJob{}
+	for _, job := range summed {
+		if state == "" || job.State == state {
+			jobs = append(jobs, *job)
+		}
+	}
+	var value = func(job recentJob) uint64 {
+		switch sortBy {
+		case "bytes":
+			return job.Bytes
+		case "ops":
+			return job.Ops
+		}
+		return job.Totals[sortBy]
+	}
+	sort.Slice(jobs, func(i, j int) bool {
+		if sortBy != "" && value(jobs[i]) != value(jobs[j]) {
+			return value(jobs[i]) > value(jobs[j])
+		}
+		if !jobs[i].LastSeen.Equal(jobs[j].LastSeen) {
+			return jobs[i].LastSeen.After(jobs[j].LastSeen)
+		}
+		return jobs[i].Job < jobs[j].Job
+	})
+	if top > 0 && top < len(jobs) {
+		jobs = jobs[:top]
+	}
+	return jobs
+}
+
+// printRecentJobs prints the -recentjobs table below the other stats tables.
+func printRecentJobs() {
+	var jobs = recentJobList(jobMode, statsFilter{}, "", "", recentJobs)
+
+	fmt.Println()
+	fmt.Println(tm.Bold(fmt.Sprintf("Recent Jobs (%s targets, totals since first seen):", jobMode)))
+	if len(jobs) == 0 {
+		fmt.Println("No jobs seen yet.")
+		return
+	}
+	fmt.Printf("%20s%9s%11s%11s%8s%13s%13s\n", "Job", "State", "First seen", "Last seen", "Targets", "Bytes",
+		"Ops")
+	for _, job := range jobs {
+		fmt.Printf("%20s%9s%11s%11s%8d%13s%13d\n", job.Job, job.State, job.FirstSeen.Format("15:04:05"),
+			job.LastSeen.Format("15:04:05"), job.Targets, humanize.Bytes(job.Bytes), job.Ops)
+	}
+}
+
+// apiRecentJobs serves /api/v1/jobs/recent?mode=all&state=expired&sort=bytes&top=10 with the device and job
+// filters of /api/v1/stats/.
+func apiRecentJobs(w http.ResponseWriter, r *http.Request) {
+	var query = r.URL.Query()
+	var mode = query.Get("mode")
+	if mode == "" {
+		mode = "all"
+	}
+	if err := validateJobOptions(mode, ""); err != nil {
+		apiError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	var state = query.Get("state")
+	if state != "" && state != "active" && state != "expired" {
+		apiError(w, http.StatusBadRequest, "unknown state %q, use active or expired", state)
+		return
+	}
+	filter, err := parseStatsFilter(query)
+	if err != nil {
+		apiError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	var top int
+	if value := query.Get("top"); value != "" {
+		if top, err = strconv.Atoi(value); err != nil || top < 1 {
+			apiError(w, http.StatusBadRequest, "invalid top %q", value)
+			return
+		}
+	}
+
+	var jobs = recentJobList(mode, statsFilter{server: filter.server, device: filter.device, job: filter.job},
+		state, query.Get("sort"), top)
+	for i := range jobs {
+		jobs[i].Totals = filter.selectCounters(jobs[i].Totals)
+	}
+	apiWrite(w, http.StatusOK, apiEnvelope{Timestamp: sampleTime, Interval: interval, Host: hostname,
+		Stats: mode, Data: jobs})
+}
@@ -0,0 +1,288 @@
+/*
+MIT License
+
+Copyright (c) 2020 storagebit.ch
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	tm "github.com/buger/goterm"
+	"github.com/dustin/go-humanize"
+)
+
+var (
+	topJobs   int
+	jobMode   string
+	jobSortBy string
+)
+
+// jobTotal is the sum of a job's stats over all targets, and over all servers with lure aggregate.
+type jobTotal struct {
+	Job      string            `json:"job"`
+	Targets  int               `json:"targets"`
+	Counters map[string]uint64 `json:"counters"`
+}
+
+func addJobFlags(flags *flag.FlagSet) {
+	flags.IntVar(&topJobs, "topjobs", 0, "Show the top N jobs summed over all targets in the console, 0 to disable")
+	flags.StringVar(&jobMode, "jobmode", "all", "Targets summed up per job: ost, mdt or all")
+	flags.StringVar(&jobSortBy, "jobsort", "write_bytes", "Counter the top jobs are sorted by")
+}
+
+// jobStatsTypes returns the job stats summed up in a job mode.
+func jobStatsTypes(mode string) []string {
+	switch mode {
+	case "ost":
+		return []string{"ostjob"}
+	case "mdt":
+		return []string{"mdtjob"}
+	case "all":
+		return []string{"ostjob", "mdtjob"}
+	}
+	return nil
+}
+
+// jobCounters returns the counters of a job mode. With all, counters of the same name are added up, e.g. the
+// read_bytes of the OSTs and of Data-on-MDT.
+func jobCounters(mode string) []string {
+	var counters []string
+	var known = make(map[string]bool)
+	for _, statsType := range jobStatsTypes(mode) {
+		for _, counter := range countersOf(statsType) {
+			if !known[counter] {
+				known[counter] = true
+				counters = append(counters, counter)
+			}
+		}
+	}
+	return counters
+}
+
+// validateJobOptions checks the job mode and a counter of it.
+func validateJobOptions(mode string, counter string) error {
+	if jobStatsTypes(mode) == nil {
+		return fmt.Errorf("unknown job mode %q, use ost, mdt or all", mode)
+	}
+	if counter == "" {
+		return nil
+	}
+	for _, statsType := range jobStatsTypes(mode) {
+		if discoverCounters[statsType] {
+			// The counters are only known once the first sample arrived.
+			return nil
+		}
+	}
+	for _, known := range jobCounters(mode) {
+		if known == counter {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown %s job counter %q", mode, counter)
+}
+
+// jobTotals sums the filtered job stats per job, or per user, executable or node with a group, sorted by the
+// counter sortBy, highest first, or by job. top 0 returns all jobs.
+func jobTotals(sample statsSample, mode string, filter statsFilter, group string, sortBy string, top int) []jobTotal {
+	var totals = make(map[string]*jobTotal)
+	// A group has a row for every job on a target, the target still counts once.
+	var targets = make(map[string]map[string]bool)
+	for _, statsType := range jobStatsTypes(mode) {
+		for _, row := range statsRows(sample, statsType, filter) {
+			var key = row.Job
+			if group != "" {
+				key = jobGroupOf(row.Job, group)
+			}
+			var total = totals[key]
+			if total == nil {
+				total = &jobTotal{Job: key, Counters: make(map[string]uint64)}
+				totals[key] = total
+				targets[key] = make(map[string]bool)
+			}
+			if !targets[key][row.Server+"/"+row.Device] {
+				targets[key][row.Server+"/"+row.Device] = true
+				total.Targets++
+			}
+			for counter, value := range row.Counters {
+				total.Counters[counter] += value
+			}
+		}
+	}
+
+	var jobs = []jobTotal{}
+	for _, total := range totals {
+		jobs = append(jobs, *total)
+	}
+	sort.Slice(jobs, func(i, j int) bool {
+		if sortBy != "" && jobs[i].Counters[sortBy] != jobs[j].Counters[sortBy] {
+			return jobs[i].Counters[sortBy] > jobs[j].Counters[sortBy]
+		}
+		return jobs[i].Job < jobs[j].Job
+	})
+	if top > 0 && top < len(jobs) {
+		jobs = jobs[:top]
+	}
+	return jobs
+}
+
+// printTopJobs prints the -topjobs table below the other stats tables.
+func printTopJobs() {
+	var jobs = jobTotals(currentSample(), jobMode, statsFilter{}, "", jobSortBy, topJobs)
+	printJobTotals(fmt.Sprintf("Top Jobs /s (%s targets, by %s):", jobMode, jobSortBy), "Job", jobs)
+}
+
+// printJobGroups prints the -jobgroup table, limited to -topjobs rows if set.
+func printJobGroups() {
+	var jobs = jobTotals(currentSample(), jobMode, statsFilter{}, jobGroup, jobSortBy, topJobs)
+	var column = strings.ToUpper(jobGroup[:1]) + jobGroup[1:]
+	printJobTotals(fmt.Sprintf("Jobs by %s /s (%s targets, by %s):", jobGroup, jobMode, jobSortBy), column, jobs)
+}
+
+func printJobTotals(title string, column string, jobs []jobTotal) {
+	var counters = jobCounters(jobMode)
+
+	fmt.Println()
+	fmt.Println(tm.Bold(title))
+	if len(jobs) == 0 {
+		fmt.Println("No Jobstats available.")
+		return
+	}
+	fmt.Printf("%20s%8s", column, "Targets")
+	for _, counter := range counters {
+		fmt.Printf("%13s", counter)
+	}
+	fmt.Print("\n")
+	for _, job := range jobs {
+		fmt.Printf("%20s%8d", job.Job, job.Targets)
+		for _, counter := range counters {
+			if v, found := job.Counters[counter]; found && strings.Contains(counter, "bytes") {
+				fmt.Printf("%13s", humanize.Bytes(v))
+			} else {
+				fmt.Printf("%13d", v)
+			}
+		}
+		fmt.Print("\n")
+	}
+}
+
+// apiJobs serves /api/v1/jobs?mode=all&sort=write_bytes&top=10 with the server, device, job and counters
+// filters of /api/v1/stats/. With group=user, executable or node the jobs are summed up by that part of their ID.
+func apiJobs(w http.ResponseWriter, r *http.Request) {
+	var query = r.URL.Query()
+	var mode = query.Get("mode")
+	if mode == "" {
+		mode = "all"
+	}
+	if err := validateJobOptions(mode, ""); err != nil {
+		apiError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	// Like /api/v1/stats/ every counter found in the job stats can be selected and sorted by.
+	var sample = currentSample()
+	var known = make(map[string]bool)
+	for _, statsType := range jobStatsTypes(mode) {
+		for _, counter := range availableCounters(sample, statsType) {
+			known[counter] = true
+		}
+	}
+	var sortBy = query.Get("sort")
+	if sortBy != "" && !known[sortBy] {
+		apiError(w, http.StatusBadRequest, "unknown %s job counter %q to sort by", mode, sortBy)
+		return
+	}
+	var group = query.Get("group")
+	if group != "" && !knownJobGroup(group) {
+		apiError(w, http.StatusBadRequest, "unknown group %q, use user, executable or node", group)
+		return
+	}
+	filter, err := parseStatsFilter(query)
+	if err != nil {
+		apiError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	for counter := range filter.counters {
+		if !known[counter] {
+			apiError(w, http.StatusBadRequest, "unknown %s job counter %q", mode, counter)
+			return
+		}
+	}
+	var top int
+	if value := query.Get("top"); value != "" {
+		if top, err = strconv.Atoi(value); err != nil || top < 1 {
+			apiError(w, http.StatusBadRequest, "invalid top %q", value)
+			return
+		}
+	}
+
+	// Sorting by a counter which isn't selected still has to see its values.
+	var jobs = jobTotals(sample, mode, statsFilter{server: filter.server, device: filter.device,
+		job: filter.job}, group, sortBy, top)
+	for i := range jobs {
+		jobs[i].Counters = filter.selectCounters(jobs[i].Counters)
+	}
+	apiWrite(w, http.StatusOK, apiEnvelope{Timestamp: sampleTime, Interval: interval, Host: hostname,
+		Stats: mode, Data: jobs})
+}
+
+// apiJobDevices serves /api/v1/jobs/devices?job=<job ID>, the drill-down of a job to the single targets.
+func apiJobDevices(w http.ResponseWriter, r *http.Request) {
+	var query = r.URL.Query()
+	var job = query.Get("job")
+	if job == "" {
+		apiError(w, http.StatusBadRequest, "the job parameter is required")
+		return
+	}
+	var mode = query.Get("mode")
+	if mode == "" {
+		mode = "all"
+	}
+	if err := validateJobOptions(mode, ""); err != nil {
+		apiError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	filter, err := parseStatsFilter(query)
+	if err != nil {
+		apiError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	// The job ID is matched exactly, job IDs may contain glob characters.
+	filter.job = ""
+
+	var targets = make(map[string][]statsRow)
+	var sample = currentSample()
+	for _, statsType := range jobStatsTypes(mode) {
+		targets[statsType] = []statsRow{}
+		for _, row := range statsRows(sample, statsType, filter) {
+			if row.Job == job {
+				targets[statsType] = append(targets[statsType], row)
+			}
+		}
+	}
+	apiWrite(w, http.StatusOK, apiEnvelope{Timestamp: sampleTime, Interval: interval, Host: hostname,
+		Stats: mode, Data: map[string]interface{}{"job": job, "targets": targets}})
+}
@@ -0,0 +1,272 @@
+/*
+MIT License
+
+Copyright (c) 2020 storagebit.ch
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Log levels, messages below -loglevel are not written.
+const (
+	levelDebug = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+var (
+	logLevel  string
+	logFormat string
+	logRepeat time.Duration
+
+	logThreshold = levelInfo
+	logJSON      bool
+	logOutput    io.Writer = os.Stderr
+	logLock      sync.Mutex
+	logRepeated  = make(map[string]*repeatedMessage)
+	logFlusher   sync.Once
+)
+
+// repeatedMessage remembers when a message was last written and how often it was suppressed since then.
+type repeatedMessage struct {
+	level      int
+	msg        string
+	fields     []interface{}
+	written    time.Time
+	suppressed int
+}
+
+// addLogFlags registers the logging flags on a flag set.
+func addLogFlags(flags *flag.FlagSet) {
+	flags.StringVar(&logLevel, "loglevel", "info", "Lowest level logged, debug, info, warn or error")
+	flags.StringVar(&logFormat, "logformat", "text", "Log format, text or json")
+	flags.DurationVar(&logRepeat, "logrepeat", time.Minute,
+		"Write identical log messages only once within this time and count the repeats, 0 writes all of them")
+}
+
+// validateLogOptions checks the logging flags.
+func validateLogOptions() error {
+	if levelOf(logLevel) < 0 {
+		return fmt.Errorf("invalid -loglevel %q, use debug, info, warn or error", logLevel)
+	}
+	if logFormat != "text" && logFormat != "json" {
+		return fmt.Errorf("invalid -logformat %q, use text or json", logFormat)
+	}
+	if logRepeat < 0 {
+		return fmt.Errorf("the -logrepeat can't be negative")
+	}
+	return nil
+}
+
+// setupLogging applies the logging flags, also after a configuration reload. The standard logger, still used
+// by the subcommands and some libraries, writes through the same format from then on.
+func setupLogging() error {
+	if err := validateLogOptions(); err != nil {
+		return err
+	}
+	logLock.Lock()
+	logThreshold = levelOf(logLevel)
+	logJSON = logFormat == "json"
+	logLock.Unlock()
+
+	log.SetFlags(0)
+	log.SetOutput(logBridge{})
+
+	// Report the repeats of messages which didn't come again, otherwise they would only show up with the
+	// next message.
+	logFlusher.Do(func() {
+		go func() {
+			for range time.Tick(10 * time.Second) {
+				logLock.Lock()
+				flushRepeatedMessages(time.Now(), "")
+				logLock.Unlock()
+			}
+		}()
+	})
+	return nil
+}
+
+func levelOf(name string) int {
+	for level, levelName := range levelNames {
+		if name == levelName {
+			return level
+		}
+	}
+	return -1
+}
+
+// The fields are key value pairs, e.g. logError("reading stats file failed", "path", path, "error", err).
+func logDebug(msg string, fields ...interface{}) {
+	logMessage(levelDebug, msg, fields)
+}
+
+func logInfo(msg string, fields ...interface{}) {
+	logMessage(levelInfo, msg, fields)
+}
+
+func logWarn(msg string, fields ...interface{}) {
+	logMessage(levelWarn, msg, fields)
+}
+
+func logError(msg string, fields ...interface{}) {
+	logMessage(levelError, msg, fields)
+}
+
+// logFatal writes the message, never rate limited, and exits like log.Fatal.
+func logFatal(msg string, fields ...interface{}) {
+	logLock.Lock()
+	writeLogMessage(time.Now(), levelError, msg, fields)
+	logLock.Unlock()
+	os.Exit(1)
+}
+
+// logMessage writes a message unless the same message with the same fields was already written within
+// -logrepeat. The next time it is written it carries the number of repeats suppressed in between, which keeps
+// e.g. a vanished target from writing the same error every sample.
+func logMessage(level int, msg string, fields []interface{}) {
+	logLock.Lock()
+	defer logLock.Unlock()
+
+	if level < logThreshold {
+		return
+	}
+	var now = time.Now()
+	if logRepeat > 0 {
+		var key = fmt.Sprintf("%d %q %v", level, msg, fields)
+		var repeated, found = logRepeated[key]
+		if found && now.Sub(repeated.written) < logRepeat {
+			repeated.suppressed++
+			return
+		}
+		logRepeated[key] = &repeatedMessage{level: level, msg: msg, fields: fields, written: now}
+		flushRepeatedMessages(now, key)
+		if found && repeated.suppressed > 0 {
+			fields = append(fields[:len(fields):len(fields)], "repeated", repeated.suppressed)
+		}
+	}
+	writeLogMessage(now, level, msg, fields)
+}
+
+// flushRepeatedMessages forgets the messages last written more than -logrepeat ago and writes how often they
+// were suppressed. Must be called with logLock held.
+func flushRepeatedMessages(now time.Time, except string) {
+	for key, repeated := range logRepeated {
+		if key == except || now.Sub(repeated.written) < logRepeat {
+			continue
+		}
+		if repeated.suppressed > 0 {
+			writeLogMessage(now, repeated.level, repeated.msg,
+				append(repeated.fields[:len(repeated.fields):len(repeated.fields)], "repeated", repeated.suppressed))
+		}
+		delete(logRepeated, key)
+	}
+}
+
+// writeLogMessage formats the message as text, e.g.
+//
+//	2020/11/02 10:15:04 ERROR reading stats file failed path=/proc/fs/lustre/... error="no such file"
+//
+// or as one JSON object per line. Must be called with logLock held.
+func writeLogMessage(now time.Time, level int, msg string, fields []interface{}) {
+	var line bytes.Buffer
+	if logJSON {
+		line.WriteString(`{"time":`)
+		writeJSONValue(&line, now.Format(time.RFC3339Nano))
+		line.WriteString(`,"level":`)
+		writeJSONValue(&line, levelNames[level])
+		line.WriteString(`,"msg":`)
+		writeJSONValue(&line, msg)
+		for i := 0; i+1 < len(fields); i += 2 {
+			line.WriteString(",")
+			writeJSONValue(&line, fmt.Sprint(fields[i]))
+			line.WriteString(":")
+			writeJSONValue(&line, logValue(fields[i+1]))
+		}
+		line.WriteString("}\n")
+	} else {
+		line.WriteString(now.Format("2006/01/02 15:04:05 "))
+		line.WriteString(strings.ToUpper(levelNames[level]))
+		line.WriteString(" ")
+		line.WriteString(msg)
+		for i := 0; i+1 < len(fields); i += 2 {
+			var value = fmt.Sprint(logValue(fields[i+1]))
+			if value == "" || strings.ContainsAny(value, " \t\n\"=") {
+				value = strconv.Quote(value)
+			}
+			fmt.Fprintf(&line, " %v=%s", fields[i], value)
+		}
+		line.WriteString("\n")
+	}
+	_, _ = logOutput.Write(line.Bytes())
+}
+
+func writeJSONValue(line *bytes.Buffer, value interface{}) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		data, _ = json.Marshal(fmt.Sprint(value))
+	}
+	line.Write(data)
+}
+
+// logValue turns errors and e.g. durations into strings, they would end up as {} or a number in JSON otherwise.
+func logValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	}
+	return value
+}
+
+// logBridge passes the lines of the standard logger on to logMessage. lure's own messages go through logInfo,
+// logError and the like, the standard logger is left to log.Fatalf and log.Panicf, so its lines are errors
+// which -loglevel must not hide. The InfluxDB client logs its write errors with "[E]! ", they are only debug
+// messages as lure logs and counts them as sink errors itself.
+type logBridge struct{}
+
+func (logBridge) Write(p []byte) (int, error) {
+	var line = strings.TrimSpace(string(p))
+	switch {
+	case strings.HasPrefix(line, "[E]! "), strings.HasPrefix(line, "[W]! "), strings.HasPrefix(line, "[I]! "),
+		strings.HasPrefix(line, "[D]! "):
+		logMessage(levelDebug, strings.Replace(line[5:], "\n", " ", -1), nil)
+	default:
+		logMessage(levelError, line, nil)
+	}
+	return len(p), nil
+}
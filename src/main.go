@@ -31,7 +31,7 @@ import (
 	tm "github.com/buger/goterm"
 	"github.com/dustin/go-humanize"
 	influxdb2 "github.com/influxdata/influxdb-client-go"
-	"io/ioutil"
+	"github.com/influxdata/influxdb-client-go/api"
 	"log"
 	"net/http"
 	"os"
@@ -42,7 +42,8 @@ import (
 )
 
 var (
-	interval int
+	interval   int
+	sampleTime time.Time
 
 	pathToMDTs             = "/proc/fs/lustre/mdt"
 	pathToOSTs             = "/proc/fs/lustre/obdfilter"
@@ -53,6 +54,11 @@ var (
 	mapLliteCalcStats   = make(map[string]map[string]uint64)
 	mapMDTJobStats      = make(map[string]map[string]map[string]uint64)
 	mapOSTJobStats      = make(map[string]map[string]map[string]uint64)
+	mapMDTTotalStats    = make(map[string]map[string]uint64)
+	mapOSTTotalStats    = make(map[string]map[string]uint64)
+	mapLliteTotalStats  = make(map[string]map[string]uint64)
+	mapMDTJobTotalStats = make(map[string]map[string]map[string]uint64)
+	mapOSTJobTotalStats = make(map[string]map[string]map[string]uint64)
 	mapMDTs             = make(map[string]string)
 	mapOSTs             = make(map[string]string)
 	mapLliteFilesystems = make(map[string]string)
@@ -99,102 +105,59 @@ var (
 
 func checkContinue(e error) {
 	if e != nil {
-		log.Printf("ERROR: %v", e)
+		logError(e.Error())
 	}
 }
 
-func getMDTs() {
-	files, err := ioutil.ReadDir(pathToMDTs)
-	checkContinue(err)
-	for _, entry := range files {
-		if entry.IsDir() {
-			log.Println("Found:", entry.Name())
-			mapMDTs[entry.Name()] = pathToMDTs + "/" + entry.Name() + "/md_stats"
-		}
-	}
-	if len(mapMDTs) == 0 {
-		log.Println("No MTDs found.")
-		ignoreMDTStats = true
-	}
-}
-
-func getOSTs() {
-	files, err := ioutil.ReadDir(pathToOSTs)
-	checkContinue(err)
-	for _, entry := range files {
-		if entry.IsDir() {
-			log.Println("Found:", entry.Name())
-			mapOSTs[entry.Name()] = pathToOSTs + "/" + entry.Name() + "/stats"
-		}
-	}
-	if len(mapOSTs) == 0 {
-		log.Println("No OSTs found.")
-		ignoreOSTStats = true
-	}
-}
-
-func getLliteFilesystems() {
-	files, err := ioutil.ReadDir(pathToLliteFilesystems)
-	checkContinue(err)
-	for _, entry := range files {
-		if entry.IsDir() {
-			log.Println("Found:", entry.Name())
-			mapLliteFilesystems[entry.Name()] = pathToLliteFilesystems + "/" + entry.Name() + "/stats"
-		}
-	}
-	if len(mapLliteFilesystems) == 0 {
-		log.Println("No mounted filesystems on this client found.")
-		client = false
-	} else {
-		client = true
-	}
-}
-
-func readStatsFile(mapDevices map[string]string) map[string][]byte {
-
-	var mapStatsRaw = make(map[string][]byte)
-
-	for key, device := range mapDevices {
-		rawStats, err := ioutil.ReadFile(device)
-		if err != nil {
-			log.Printf("ERROR: %v", err)
-		} else {
-			mapStatsRaw[key] = rawStats
-		}
-	}
-	return mapStatsRaw
+// readStatsFile reads the stats file of every device, see readFiles. The collector is mdt, ost or client.
+func readStatsFile(mapDevices map[string]string, collector string) map[string][]byte {
+	return readFiles(collector, mapDevices)
 }
 
+// readJobStatsFile reads the job_stats of every MDT or OST, the deviceType is mdt or obdfilter.
 func readJobStatsFile(mapDevices map[string]string, deviceType string) map[string][]byte {
-
-	var mapStatsRaw = make(map[string][]byte)
-
-	for key := range mapDevices {
-		rawStats, err := ioutil.ReadFile("/proc/fs/lustre/" + deviceType + "/" + key + "/job_stats")
-		if err != nil {
-			log.Printf("ERROR: %v", err)
-		} else {
-			mapStatsRaw[key] = rawStats
-		}
+	var collector = "mdtjob"
+	if deviceType == "obdfilter" {
+		collector = "ostjob"
 	}
-	return mapStatsRaw
+
+	var _, _, files = jobStatsCollector{collector, deviceType, &mapDevices}.CaptureFiles()
+	return readFiles(collector, files)
 }
 
-func parseRAWSats(mapRAWStats map[string][]byte) map[string]map[string]uint64 {
+// parseRAWSats parses the stats files read by readStatsFile. Lines which can't be parsed are skipped and
+// counted as parse errors of the collector.
+func parseRAWSats(mapRAWStats map[string][]byte, collector string) map[string]map[string]uint64 {
 
 	var mapStats = make(map[string]map[string]uint64)
 
 	for device, value := range mapRAWStats {
 		var slcStats = strings.Split(string(value), "\n")
+		if len(slcStats) < 2 {
+			parseFailed(collector, device, "", "empty stats file")
+			continue
+		}
 		slcStats = slcStats[1 : len(slcStats)-1]
 		var mapCounters = make(map[string]uint64)
 
 		for _, item := range slcStats {
 			var fields = strings.Fields(item)
+			if len(fields) == 0 {
+				parseFailed(collector, device, "", "empty line")
+				continue
+			}
+			var field = 1
 			if strings.Contains(fields[0], "bytes") {
-				mapCounters[fields[0]], _ = strconv.ParseUint(fields[6], 10, 64)
-			} else {
-				mapCounters[fields[0]], _ = strconv.ParseUint(fields[1], 10, 64)
+				field = 6
+			}
+			if len(fields) <= field {
+				parseFailed(collector, device, fields[0], "too few fields")
+				continue
+			}
+			var err error
+			mapCounters[fields[0]], err = strconv.ParseUint(fields[field], 10, 64)
+			if err != nil && !timeCounters[fields[0]] {
+				parseFailed(collector, device, fields[0], err.Error())
 			}
 			mapStats[device] = mapCounters
 		}
@@ -202,22 +165,37 @@ func parseRAWSats(mapRAWStats map[string][]byte) map[string]map[string]uint64 {
 	return mapStats
 }
 
-func calcStats(mapPrevStats map[string]map[string]uint64, mapNewStats map[string]map[string]uint64) map[string]map[string]uint64 {
+// parseFailed counts and logs a line of a stats file which couldn't be parsed.
+func parseFailed(collector string, device string, counter string, reason string) {
+	lureMetrics.add("collector."+collector, "parse_errors", 1)
+	logWarn("parsing stats failed", "collector", collector, "device", device, "counter", counter,
+		"reason", reason)
+}
+
+// calcStats turns the counters read seconds apart into rates per second. Devices which are gone are left out.
+func calcStats(mapPrevStats map[string]map[string]uint64, mapNewStats map[string]map[string]uint64, seconds uint64) map[string]map[string]uint64 {
 
 	var mapStats = make(map[string]map[string]uint64)
 
 	for device, value := range mapPrevStats {
+		if _, found := mapNewStats[device]; !found {
+			continue
+		}
 		var mapCounter = make(map[string]uint64)
 		for key := range value {
-			var calcCounter = (mapNewStats[device][key] - mapPrevStats[device][key]) / uint64(interval)
-			mapCounter[key] = calcCounter
+			// A counter lower than before was reset, e.g. by a remount of the target, it counts from zero.
+			var previous = mapPrevStats[device][key]
+			if mapNewStats[device][key] < previous {
+				previous = 0
+			}
+			mapCounter[key] = (mapNewStats[device][key] - previous) / seconds
 		}
 		mapStats[device] = mapCounter
 	}
 	return mapStats
 }
 
-func parseRAWJobStats(mapRAWJobStats map[string][]byte) map[string]map[string]map[string]uint64 {
+func parseRAWJobStats(mapRAWJobStats map[string][]byte, collector string) map[string]map[string]map[string]uint64 {
 
 	var mapJobStats = make(map[string]map[string]map[string]uint64)
 
@@ -229,19 +207,33 @@ func parseRAWJobStats(mapRAWJobStats map[string][]byte) map[string]map[string]ma
 			var mapStats = make(map[string]map[string]uint64)
 			for _, item := range slcAllJobStats[1:] {
 				slcJobStats := strings.Split(item, "\n")
-				jobName := strings.Fields(slcJobStats[0])[1]
+				var jobFields = strings.Fields(slcJobStats[0])
+				if len(jobFields) < 2 || len(slcJobStats) < 2 {
+					parseFailed(collector, device, "job_id", "no job id")
+					continue
+				}
+				jobName := jobFields[1]
 				var mapCounters = make(map[string]uint64)
 
 				for _, line := range slcJobStats[2:] {
-					if len(line) > 0 {
-						var fields = strings.Fields(line)
-						var counter = strings.TrimSuffix(strings.Fields(line)[0], ":")
-
+					var fields = strings.Fields(line)
+					if len(fields) > 0 {
+						var counter = strings.TrimSuffix(fields[0], ":")
+						if timeCounters[counter] {
+							continue
+						}
+						var field = 3
 						if strings.Contains(fields[0], "bytes") {
-							mapCounters[counter], _ = strconv.ParseUint(fields[11], 10, 64)
-						} else {
-							var counterValue = strings.TrimSuffix(strings.Fields(line)[3], ",")
-							mapCounters[counter], _ = strconv.ParseUint(counterValue, 10, 64)
+							field = 11
+						}
+						if len(fields) <= field {
+							parseFailed(collector, device, counter, "too few fields")
+							continue
+						}
+						var err error
+						mapCounters[counter], err = strconv.ParseUint(strings.TrimSuffix(fields[field], ","), 10, 64)
+						if err != nil {
+							parseFailed(collector, device, counter, err.Error())
 						}
 						mapStats[jobName] = mapCounters
 					}
@@ -253,20 +245,27 @@ func parseRAWJobStats(mapRAWJobStats map[string][]byte) map[string]map[string]ma
 	return mapJobStats
 }
 
-func calcJobStats(mapPrevJobStats map[string]map[string]map[string]uint64, mapNewJobStats map[string]map[string]map[string]uint64) map[string]map[string]map[string]uint64 {
+// calcJobStats is calcStats for job stats. Jobs which are new or which Lustre cleaned up and started again in
+// between count from zero, so they show up with the first sample they are seen in.
+func calcJobStats(mapPrevJobStats map[string]map[string]map[string]uint64, mapNewJobStats map[string]map[string]map[string]uint64, seconds uint64) map[string]map[string]map[string]uint64 {
 
 	var mapJobStats = make(map[string]map[string]map[string]uint64)
 
-	for device, jobs := range mapPrevJobStats {
+	for device, jobs := range mapNewJobStats {
+		if _, found := mapPrevJobStats[device]; !found {
+			continue
+		}
 		var mapJobs = make(map[string]map[string]uint64)
 
 		for job, counters := range jobs {
 			var mapCounter = make(map[string]uint64)
 
-			for key := range counters {
-				var counter uint64
-				counter = (mapNewJobStats[device][job][key] - mapPrevJobStats[device][job][key]) / uint64(interval)
-				mapCounter[key] = counter
+			for key, value := range counters {
+				var previous = mapPrevJobStats[device][job][key]
+				if value < previous {
+					previous = 0
+				}
+				mapCounter[key] = (value - previous) / seconds
 			}
 			mapJobs[job] = mapCounter
 		}
@@ -324,7 +323,12 @@ func printStats(mapStats map[string]map[string]uint64, slcDevices []string, slcC
 	fmt.Print("\n")
 	for _, device := range slcDevices {
 		if client == true {
-			fmt.Printf("%10s", strings.Split(device, "-")[0])
+			var server, mount = splitServer(device)
+			if server != "" {
+				fmt.Printf("%10s", server+"/"+filesystemOf(mount))
+			} else {
+				fmt.Printf("%10s", filesystemOf(mount))
+			}
 		} else {
 			fmt.Printf("%20s", device)
 		}
@@ -345,8 +349,7 @@ func printStats(mapStats map[string]map[string]uint64, slcDevices []string, slcC
 
 func feedStatsToInflux(mapStats map[string]map[string]uint64, slcDevices []string, slcCounters []string) {
 
-	influxClient := influxdb2.NewClient("http://"+influxServer+":"+influxPort, influxToken)
-	var influxWriteAPI = influxClient.WriteAPI(influxOrg, influxBucket)
+	influxClient, influxWriteAPI := influxWriter()
 
 	for _, device := range slcDevices {
 		influxLine := "lure,server=" + hostname + ",device=" + device + ",type=stats "
@@ -362,6 +365,39 @@ func feedStatsToInflux(mapStats map[string]map[string]uint64, slcDevices []strin
 	influxClient.Close()
 }
 
+// influxWriter connects to InfluxDB. The writes are asynchronous, their errors are counted and logged in the
+// background until the client is closed.
+func influxWriter() (influxdb2.Client, api.WriteAPI) {
+	influxClient := influxdb2.NewClient("http://"+influxServer+":"+influxPort, influxToken)
+	var influxWriteAPI = influxClient.WriteAPI(influxOrg, influxBucket)
+	var errors = influxWriteAPI.Errors()
+	go func() {
+		for err := range errors {
+			sinkFailed("influxdb", err)
+		}
+	}()
+	return influxClient, influxWriteAPI
+}
+
+// feedSelfMetricsToInflux writes lure's own metrics with type=self, one line per component.
+func feedSelfMetricsToInflux(metrics map[string]map[string]uint64, slcComponents []string, slcCounters []string) {
+
+	influxClient, influxWriteAPI := influxWriter()
+
+	for _, component := range slcComponents {
+		var fieldKeyValues []string
+		for _, counter := range slcCounters {
+			if v, found := metrics[component][counter]; found {
+				fieldKeyValues = append(fieldKeyValues, counter+"="+strconv.FormatUint(v, 10))
+			}
+		}
+		influxWriteAPI.WriteRecord("lure,server=" + hostname + ",component=" + component + ",type=self " +
+			strings.Join(fieldKeyValues, ","))
+	}
+	influxWriteAPI.Flush()
+	influxClient.Close()
+}
+
 func printJobStats(mapJobStats map[string]map[string]map[string]uint64, slcJobs []string, slcCounters []string) {
 
 	fmt.Printf("%20s", "Job @ Device")
@@ -374,7 +410,8 @@ func printJobStats(mapJobStats map[string]map[string]map[string]uint64, slcJobs
 	for _, jobHash := range slcJobs {
 		var device = strings.Split(jobHash, "@@")[0]
 		var job = strings.Split(jobHash, "@@")[1]
-		fmt.Printf("%20s", job+"@"+strings.Split(device, "-")[1])
+		var _, target = splitServer(device)
+		fmt.Printf("%20s", job+"@"+strings.Split(target, "-")[1])
 		for _, counter := range slcCounters {
 			if v, found := mapJobStats[device][job][counter]; found {
 				if strings.Contains(counter, "bytes") {
@@ -392,14 +429,14 @@ func printJobStats(mapJobStats map[string]map[string]map[string]uint64, slcJobs
 
 func feedJobStatsToInflux(mapJobStats map[string]map[string]map[string]uint64, slcJobs []string, slcCounters []string) {
 
-	influxClient := influxdb2.NewClient("http://"+influxServer+":"+influxPort, influxToken)
-	var influxWriteAPI = influxClient.WriteAPI(influxOrg, influxBucket)
+	influxClient, influxWriteAPI := influxWriter()
 
 	for _, jobHash := range slcJobs {
 		var device = strings.Split(jobHash, "@@")[0]
 		var job = strings.Split(jobHash, "@@")[1]
 
-		influxLine := "lure,server=" + hostname + ",device=" + device + ",type=job_stats," + "job=" + job + " "
+		influxLine := "lure,server=" + hostname + ",device=" + device + ",type=job_stats," + "job=" + job +
+			influxJobTags(job) + " "
 		var fieldKeyValues []string
 		for _, counter := range slcCounters {
 			if v, found := mapJobStats[device][job][counter]; found {
@@ -412,25 +449,87 @@ func feedJobStatsToInflux(mapJobStats map[string]map[string]map[string]uint64, s
 	influxClient.Close()
 }
 
-func main() {
-
-	var httpPort int
-
-	flag.IntVar(&interval, "interval", 1, "Sample interval in seconds")
-	flag.IntVar(&httpPort, "port", 8666, "HTTP port used to access the the stats via web browser.")
-	flag.BoolVar(&ignoreMDTStats, "ignoremdt", false, "Don't report MDT stats.")
-	flag.BoolVar(&ignoreOSTStats, "ignoreost", false, "Don't report OST stats.")
-	flag.BoolVar(&reportJobStats, "jobstats", false, "Report Lustre Jobstats for MDT and OST devices.")
-	flag.BoolVar(&runDaemonized, "daemon", false, "Run as daemon in the background. No console output but stats available via web interface.")
-	flag.BoolVar(&flgVersion, "version", false, "Print version information.")
-	flag.BoolVar(&feedToInflux, "feedtoinflux", false, "Store statistics in InfluxDB")
-	flag.StringVar(&influxServer, "influxserver", "localhost", "InfluxDB server name or IP")
-	flag.StringVar(&influxPort, "influxport", "8086", "InfluxDB server port")
-	flag.StringVar(&influxOrg, "influxorg", "storagebit", "InfluxDB org")
-	flag.StringVar(&influxBucket, "influxbucket", "lure", "InfluxDB bucket")
-	flag.StringVar(&influxToken, "influxtoken",
+// addMainFlags registers the flags of the lure agent, they are shared with lure config check.
+func addMainFlags(flags *flag.FlagSet) {
+	flags.StringVar(&configFile, "config", "", "YAML configuration file, e.g. /etc/lure/lure.yaml, flags override its settings")
+	flags.IntVar(&interval, "interval", 1, "Sample interval in seconds")
+	addHTTPFlags(flags)
+	flags.BoolVar(&ignoreMDTStats, "ignoremdt", false, "Don't report MDT stats.")
+	flags.BoolVar(&ignoreOSTStats, "ignoreost", false, "Don't report OST stats.")
+	flags.BoolVar(&reportJobStats, "jobstats", false, "Report Lustre Jobstats for MDT and OST devices.")
+	flags.BoolVar(&runDaemonized, "daemon", false, "Run as daemon in the background. No console output but stats available via web interface.")
+	flags.BoolVar(&flgVersion, "version", false, "Print version information.")
+	flags.BoolVar(&feedToInflux, "feedtoinflux", false, "Store statistics in InfluxDB")
+	flags.StringVar(&influxServer, "influxserver", "localhost", "InfluxDB server name or IP")
+	flags.StringVar(&influxPort, "influxport", "8086", "InfluxDB server port")
+	flags.StringVar(&influxOrg, "influxorg", "storagebit", "InfluxDB org")
+	flags.StringVar(&influxBucket, "influxbucket", "lure", "InfluxDB bucket")
+	flags.StringVar(&influxToken, "influxtoken",
 		"lure:password",
 		"Read/Write token for the bucket or user:password in the InfluxDB")
+	flags.BoolVar(&feedToStatsd, "feedtostatsd", false, "Send statistics to a StatsD or DogStatsD agent")
+	flags.StringVar(&statsdAddress, "statsdaddress", "localhost:8125",
+		"StatsD agent as host:port for UDP or unix:///path/to/socket for a unix datagram socket")
+	flags.StringVar(&statsdPrefix, "statsdprefix", "lure", "Prefix for all StatsD metric names")
+	flags.Float64Var(&statsdSampleRate, "statsdsamplerate", 1, "StatsD sample rate between 0 and 1, only applies to -statsdtype counter")
+	flags.StringVar(&statsdType, "statsdtype", "gauge", "StatsD metric type used for the stats, gauge or counter")
+	flags.BoolVar(&statsdTags, "statsdtags", false,
+		"Use DogStatsD tags for server, device and job instead of encoding them into the metric name")
+	flags.BoolVar(&feedToOTLP, "feedtootlp", false, "Export statistics to an OpenTelemetry collector via OTLP")
+	flags.StringVar(&otlpEndpoint, "otlpendpoint", "localhost:4317", "OTLP collector host:port")
+	flags.StringVar(&otlpProtocol, "otlpprotocol", "grpc", "OTLP protocol, grpc or http/protobuf")
+	flags.BoolVar(&otlpInsecure, "otlpinsecure", false, "Connect to the OTLP collector without TLS")
+	flags.StringVar(&otlpHeaders, "otlpheaders", "", "Additional OTLP request headers as key=value,key=value")
+	flags.IntVar(&otlpBatchSize, "otlpbatchsize", 5000, "Maximum number of data points per OTLP export request")
+	flags.DurationVar(&otlpFlushInterval, "otlpflushinterval", 10*time.Second,
+		"Maximum time data points are batched before they are exported")
+	flags.IntVar(&otlpRetries, "otlpretries", 5, "Number of retries for a failed OTLP export")
+	flags.DurationVar(&otlpRetryBackoff, "otlpretrybackoff", time.Second,
+		"Wait time before the first OTLP retry, doubled with every further retry")
+	flags.DurationVar(&otlpTimeout, "otlptimeout", 10*time.Second, "Timeout for a single OTLP export request")
+	flags.StringVar(&recordDir, "record", "", "Record every sample to files in this directory")
+	flags.StringVar(&recordFormat, "recordformat", "ndjson", "Recording file format, ndjson or csv")
+	flags.Int64Var(&recordMaxSize, "recordmaxsize", 100, "Rotate the recording file once it reaches this size in MB")
+	flags.DurationVar(&recordMaxAge, "recordmaxage", 24*time.Hour, "Rotate the recording file after this time")
+	flags.IntVar(&recordRetention, "recordretention", 30, "Number of rotated and compressed recording files to keep")
+	addHistoryFlags(flags)
+	addJobFlags(flags)
+	addCounterFlags(flags)
+	addBatchFlags(flags)
+	addShutdownFlags(flags)
+	addLogFlags(flags)
+	addCollectorFlags(flags)
+	addReadFlags(flags)
+	addJobLifeFlags(flags)
+	addJobIDFlags(flags)
+}
+
+func main() {
+
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "replay":
+			runReplay(os.Args[2:])
+			return
+		case "capture":
+			runCapture(os.Args[2:])
+			return
+		case "analyze":
+			runAnalyze(os.Args[2:])
+			return
+		case "aggregate":
+			runAggregate(os.Args[2:])
+			return
+		case "config":
+			runConfig(os.Args[2:])
+			return
+		case "install-unit":
+			runInstallUnit(os.Args[2:])
+			return
+		}
+	}
+
+	addMainFlags(flag.CommandLine)
 
 	flag.Parse()
 
@@ -443,219 +542,167 @@ func main() {
 		os.Exit(0)
 	}
 
-	go func() {
-		http.HandleFunc("/stats", httpStats)
-		http.HandleFunc("/json", jsonStats)
-		var baseURL = "localhost:" + strconv.Itoa(httpPort)
-		err := http.ListenAndServe(baseURL, nil)
-		checkContinue(err)
-	}()
-
-	if ignoreMDTStats != true {
-		getMDTs()
+	if err := loadConfig(configFile, flag.CommandLine); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	if err := validateOptions(); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
 	}
+	if err := history.setup(historyTiers, historyMaxMem); err != nil {
+		log.Fatalf("Invalid -history: %v", err)
+	}
+	checkContinue(setupLogging())
 
-	if ignoreOSTStats != true {
-		getOSTs()
+	if feedToOTLP {
+		startOTLPExporter()
+	}
+	if recordDir != "" {
+		if err := startRecording(); err != nil {
+			logFatal("can't record samples", "error", err)
+		}
 	}
 
-	getLliteFilesystems()
+	reloadInSampleLoop = true
+	startReloadHandler()
+	startShutdownHandler()
+	if noHTTP != true {
+		startHTTPServer(listenAddresses(httpListen, httpPort))
+	}
 
-	for {
-		timeInterval := time.Duration(interval) * time.Second
+	discoverDevices()
+	// The first run of the collectors is the baseline for the rates of the first sample.
+	collect(time.Now())
 
-		if runDaemonized != true {
-			tm.Clear()
-			tm.MoveCursor(1, 1)
-			currentTime := time.Now()
-			strHeader := "Lustre node: " + hostname + " | Time: " + currentTime.String() + " | Sample Interval: " +
-				strconv.Itoa(interval) + "s"
-			_, _ = tm.Println(tm.Background(tm.Color(tm.Bold(strHeader), tm.BLACK), tm.GREEN))
-		}
-
-		var mapMDTPrevStats = make(map[string]map[string]uint64)
-		var mapMDTNewStats = make(map[string]map[string]uint64)
-		var mapMDTPrevStatsRaw = make(map[string][]byte)
-		var mapMDTNewStatsRaw = make(map[string][]byte)
-		var mapMDTNewJobStatsRaw = make(map[string][]byte)
-		var mapOSTPrevStats = make(map[string]map[string]uint64)
-		var mapOSTNewStats = make(map[string]map[string]uint64)
-		var mapOSTPrevStatsRaw = make(map[string][]byte)
-		var mapOSTNewStatsRaw = make(map[string][]byte)
-		var mapMDTPrevJobStats = make(map[string]map[string]map[string]uint64)
-		var mapMDTNewJobStats = make(map[string]map[string]map[string]uint64)
-		var mapMDTPrevJobStatsRaw = make(map[string][]byte)
-		var mapOSTNewJobStats = make(map[string]map[string]map[string]uint64)
-		var mapOSTPrevJobStats = make(map[string]map[string]map[string]uint64)
-		var mapOSTPrevJobStatsRaw = make(map[string][]byte)
-		var mapOSTNewJobStatsRaw = make(map[string][]byte)
-		var mapLlitePrevStats = make(map[string]map[string]uint64)
-		var mapLliteNewStats = make(map[string]map[string]uint64)
-		var mapLlitePrevStatsRaw = make(map[string][]byte)
-		var mapLliteNewStatsRaw = make(map[string][]byte)
-
-		if (ignoreMDTStats != true) && (client != true) {
-			mapMDTPrevStatsRaw = readStatsFile(mapMDTs)
-		}
-
-		if (ignoreOSTStats != true) && (client != true) {
-			mapOSTPrevStatsRaw = readStatsFile(mapOSTs)
-		}
+	var console *tui
+	if runDaemonized != true && batchMode != true {
+		console = startTUI()
+	}
+	sdReady()
 
-		if client == true {
-			mapLlitePrevStatsRaw = readStatsFile(mapLliteFilesystems)
+	for {
+		select {
+		case interval = <-intervalRequests:
+		case reply := <-reloadRequests:
+			reply <- reloadConfig()
+		default:
 		}
+		timeInterval := time.Duration(interval) * time.Second
 
-		if (reportJobStats == true) && (client != true) {
-			mapMDTPrevJobStatsRaw = readJobStatsFile(mapMDTs, "mdt")
-			mapOSTPrevJobStatsRaw = readJobStatsFile(mapOSTs, "obdfilter")
+		if waitForNextSample(timeInterval) {
+			shutdown()
 		}
+		sampleTime = time.Now()
+		collect(sampleTime)
 
-		time.Sleep(timeInterval)
+		sortedMTDDevices = sortStatsMapIntoSlice(mapMDTCalcStats)
+		sortedOSTDevices = sortStatsMapIntoSlice(mapOSTCalcStats)
+		sortedLliteFilesystems = sortStatsMapIntoSlice(mapLliteCalcStats)
+		sortedMDTJobs = sortJobsMapIntoSlice(mapMDTJobStats)
+		sortedOSTJobs = sortJobsMapIntoSlice(mapOSTJobStats)
 
-		if (ignoreMDTStats != true) && (client != true) {
-			mapMDTNewStatsRaw = readStatsFile(mapMDTs)
+		updateDiscoveredCounters(currentSample())
+		if batchMode {
+			printBatch(currentSample())
+		} else if console != nil {
+			console.update(currentSample())
+		} else if runDaemonized != true {
+			printConsole()
 		}
 
-		if (ignoreOSTStats != true) && (client != true) {
-			mapOSTNewStatsRaw = readStatsFile(mapOSTs)
+		feedSinks()
+		logDebug("sample taken", "duration", time.Since(sampleTime), "mdts", len(mapMDTCalcStats),
+			"osts", len(mapOSTCalcStats), "filesystems", len(mapLliteCalcStats), "jobs",
+			len(sortedMDTJobs)+len(sortedOSTJobs))
+		sdSampled()
+		if countSample() {
+			shutdown()
 		}
+	}
+}
 
-		if client == true {
-			mapLliteNewStatsRaw = readStatsFile(mapLliteFilesystems)
-		}
+// statsHeader is the first line of the console and web output.
+func statsHeader() string {
+	var currentTime = sampleTime
+	if currentTime.IsZero() {
+		currentTime = time.Now()
+	}
+	return "Lustre node: " + currentSampleHost() + " | Time: " + currentTime.String() + " | Sample Interval: " +
+		strconv.Itoa(interval) + "s"
+}
 
-		if reportJobStats == true {
-			mapMDTNewJobStatsRaw = readJobStatsFile(mapMDTs, "mdt")
-			mapOSTNewJobStatsRaw = readJobStatsFile(mapOSTs, "obdfilter")
-		}
+// printConsole clears the terminal and renders the latest stats.
+func printConsole() {
+	tm.Clear()
+	tm.MoveCursor(1, 1)
+	_, _ = tm.Println(tm.Background(tm.Color(tm.Bold(statsHeader()), tm.BLACK), tm.GREEN))
+	tm.Flush()
+	printStatsTables()
+}
 
-		if (ignoreMDTStats != true) && (client != true) {
-			mapMDTPrevStats = parseRAWSats(mapMDTPrevStatsRaw)
-			mapMDTNewStats = parseRAWSats(mapMDTNewStatsRaw)
-			mapMDTCalcStats = calcStats(mapMDTPrevStats, mapMDTNewStats)
+// printStatsTables prints the tables for all stats types relevant for this node.
+func printStatsTables() {
+	if client != true {
+		fmt.Println(tm.Bold("MDT Metadata Stats /s:"))
+		if len(mapMDTCalcStats) != 0 {
+			printStats(mapMDTCalcStats, sortedMTDDevices, mdtCounters)
+		} else {
+			fmt.Println("No MDT stats available.")
 		}
-		if (ignoreOSTStats != true) && (client != true) {
-			mapOSTPrevStats = parseRAWSats(mapOSTPrevStatsRaw)
-			mapOSTNewStats = parseRAWSats(mapOSTNewStatsRaw)
-			mapOSTCalcStats = calcStats(mapOSTPrevStats, mapOSTNewStats)
+		fmt.Println()
+	}
+	if client != true {
+		fmt.Println(tm.Bold("OST Operation Stats /s:"))
+		if len(mapOSTCalcStats) != 0 {
+			printStats(mapOSTCalcStats, sortedOSTDevices, ostCounters)
+		} else {
+			fmt.Println("No OST stats available.")
 		}
-
-		if client == true {
-			mapLlitePrevStats = parseRAWSats(mapLlitePrevStatsRaw)
-			mapLliteNewStats = parseRAWSats(mapLliteNewStatsRaw)
-			mapLliteCalcStats = calcStats(mapLlitePrevStats, mapLliteNewStats)
+		fmt.Println()
+	}
+	if client == true {
+		fmt.Println(tm.Bold("Client Operation Stats /s:"))
+		if len(mapLliteCalcStats) != 0 {
+			printStats(mapLliteCalcStats, sortedLliteFilesystems, lliteCounters)
+		} else {
+			fmt.Println("No Client stats available.")
 		}
-
-		if reportJobStats == true {
-			mapMDTPrevJobStats = parseRAWJobStats(mapMDTPrevJobStatsRaw)
-			mapMDTNewJobStats = parseRAWJobStats(mapMDTNewJobStatsRaw)
-			mapOSTPrevJobStats = parseRAWJobStats(mapOSTPrevJobStatsRaw)
-			mapOSTNewJobStats = parseRAWJobStats(mapOSTNewJobStatsRaw)
-			mapMDTJobStats = calcJobStats(mapMDTPrevJobStats, mapMDTNewJobStats)
-			mapOSTJobStats = calcJobStats(mapOSTPrevJobStats, mapOSTNewJobStats)
-			sortedMDTJobs = sortJobsMapIntoSlice(mapMDTJobStats)
-			sortedOSTJobs = sortJobsMapIntoSlice(mapOSTJobStats)
+		fmt.Println()
+	}
+	if client != true {
+		fmt.Println(tm.Bold("MDT Jobstats /s:"))
+		if len(mapMDTJobStats) != 0 {
+			printJobStats(mapMDTJobStats, sortedMDTJobs, mdtJobStatsCounters)
+		} else {
+			fmt.Println("No MDT Jobstats available.")
 		}
-
-		sortedMTDDevices = sortStatsMapIntoSlice(mapMDTCalcStats)
-		sortedOSTDevices = sortStatsMapIntoSlice(mapOSTCalcStats)
-		sortedLliteFilesystems = sortStatsMapIntoSlice(mapLliteCalcStats)
-
-		if runDaemonized != true {
-
-			tm.Flush()
-			if client != true {
-				fmt.Println(tm.Bold("MDT Metadata Stats /s:"))
-				if len(mapMDTCalcStats) != 0 {
-					printStats(mapMDTCalcStats, sortedMTDDevices, mdtCounters)
-					if feedToInflux {
-						feedStatsToInflux(mapMDTCalcStats, sortedMTDDevices, mdtCounters)
-					}
-				} else {
-					fmt.Println("No MDT stats available.")
-				}
-				fmt.Println()
-			}
-			if client != true {
-				fmt.Println(tm.Bold("OST Operation Stats /s:"))
-				if len(mapOSTCalcStats) != 0 {
-					printStats(mapOSTCalcStats, sortedOSTDevices, ostCounters)
-					if feedToInflux {
-						feedStatsToInflux(mapOSTCalcStats, sortedOSTDevices, ostCounters)
-					}
-				} else {
-					fmt.Println("No OST stats available.")
-				}
-				fmt.Println()
-			}
-			if client == true {
-				fmt.Println(tm.Bold("Client Operation Stats /s:"))
-				if len(mapLliteCalcStats) != 0 {
-					printStats(mapLliteCalcStats, sortedLliteFilesystems, lliteCounters)
-					if feedToInflux {
-						feedStatsToInflux(mapLliteCalcStats, sortedLliteFilesystems, lliteCounters)
-					}
-				} else {
-					fmt.Println("No Client stats available.")
-				}
-				fmt.Println()
-			}
-			if client != true {
-				fmt.Println(tm.Bold("MDT Jobstats /s:"))
-				if len(mapMDTJobStats) != 0 {
-					printJobStats(mapMDTJobStats, sortedMDTJobs, mdtJobStatsCounters)
-					if feedToInflux {
-						feedJobStatsToInflux(mapMDTJobStats, sortedMDTJobs, mdtJobStatsCounters)
-					}
-				} else {
-					fmt.Println("No MDT Jobstats available.")
-				}
-				fmt.Println()
-			}
-			if client != true {
-				fmt.Println(tm.Bold("OST Jobstats /s:"))
-				if len(mapOSTJobStats) != 0 {
-					printJobStats(mapOSTJobStats, sortedOSTJobs, ostJobStatsCounters)
-					if feedToInflux {
-						feedJobStatsToInflux(mapOSTJobStats, sortedOSTJobs, ostJobStatsCounters)
-					}
-				} else {
-					fmt.Println("No OST Jobstats available.")
-				}
-			}
+		fmt.Println()
+	}
+	if client != true {
+		fmt.Println(tm.Bold("OST Jobstats /s:"))
+		if len(mapOSTJobStats) != 0 {
+			printJobStats(mapOSTJobStats, sortedOSTJobs, ostJobStatsCounters)
 		} else {
-			if feedToInflux {
-				if len(mapMDTCalcStats) != 0 {
-					feedStatsToInflux(mapMDTCalcStats, sortedMTDDevices, mdtCounters)
-				}
-				if len(mapOSTCalcStats) != 0 {
-					feedStatsToInflux(mapOSTCalcStats, sortedOSTDevices, ostCounters)
-				}
-				if len(mapLliteCalcStats) != 0 {
-					feedStatsToInflux(mapLliteCalcStats, sortedLliteFilesystems, lliteCounters)
-				}
-				if len(mapMDTJobStats) != 0 {
-					feedJobStatsToInflux(mapMDTJobStats, sortedMDTJobs, mdtJobStatsCounters)
-				}
-				if len(mapOSTJobStats) != 0 {
-					feedJobStatsToInflux(mapOSTJobStats, sortedOSTJobs, ostJobStatsCounters)
-				}
-			}
+			fmt.Println("No OST Jobstats available.")
 		}
 	}
+	if client != true && topJobs > 0 {
+		printTopJobs()
+	}
+	if client != true && jobGroup != "" {
+		printJobGroups()
+	}
+	if client != true && recentJobs > 0 {
+		printRecentJobs()
+	}
 }
 
 func httpStats(w http.ResponseWriter, _ *http.Request) {
-	currentTime := time.Now()
-	strHeader := "Lustre node: " + hostname + " | Time: " + currentTime.String() + " | Sample Interval: " +
-		strconv.Itoa(interval) + "s"
-	_, _ = fmt.Fprintln(w, strHeader)
+	_, _ = fmt.Fprintln(w, statsHeader())
 	if client != true {
 		_, _ = fmt.Fprintln(w, "MDT Metadata Stats /s:")
-		_, _ = fmt.Fprintf(w, "%15s", "Device")
+		_, _ = fmt.Fprintf(w, "%20s", "Device")
 		for _, item := range mdtCounters {
-			_, _ = fmt.Fprintf(w, "%10s", item)
+			_, _ = fmt.Fprintf(w, "%13s", item)
 		}
 		_, _ = fmt.Fprint(w, "\n")
 
@@ -663,7 +710,11 @@ func httpStats(w http.ResponseWriter, _ *http.Request) {
 			_, _ = fmt.Fprintf(w, "%20s", mdt)
 			for _, counter := range mdtCounters {
 				if v, found := counters[counter]; found {
-					_, _ = fmt.Fprintf(w, "%13d", v)
+					if strings.Contains(counter, "bytes") {
+						_, _ = fmt.Fprintf(w, "%13s", humanize.Bytes(v))
+					} else {
+						_, _ = fmt.Fprintf(w, "%13d", v)
+					}
 				} else {
 					_, _ = fmt.Fprintf(w, "%13d", 0)
 				}
@@ -720,9 +771,6 @@ func httpStats(w http.ResponseWriter, _ *http.Request) {
 		_, _ = fmt.Fprint(w, "\n")
 	}
 	if client != true {
-		_, _ = fmt.Fprint(w, "MDT Jobstats /s:")
-		_, _ = fmt.Fprint(w, "\n")
-
 		_, _ = fmt.Fprint(w, "MDT Jobstats /s:")
 		_, _ = fmt.Fprint(w, "\n")
 		if len(mapMDTJobStats) != 0 {
@@ -749,10 +797,12 @@ func httpStats(w http.ResponseWriter, _ *http.Request) {
 				}
 			}
 		} else {
-			_, _ = fmt.Fprint(w, "\nNo MDT Jobstats available.")
+			_, _ = fmt.Fprintln(w, "No MDT Jobstats available.")
 		}
 	}
 	if client != true {
+		_, _ = fmt.Fprint(w, "\nOST Jobstats /s:")
+		_, _ = fmt.Fprint(w, "\n")
 		if len(mapOSTJobStats) != 0 {
 			_, _ = fmt.Fprintf(w, "%20s", "Job @ Device")
 			for _, item := range ostJobStatsCounters {
@@ -762,7 +812,7 @@ func httpStats(w http.ResponseWriter, _ *http.Request) {
 			for ost, jobs := range mapOSTJobStats {
 				for job, counters := range jobs {
 					_, _ = fmt.Fprintf(w, "%20s", job+"@"+strings.Split(ost, "-")[1])
-					for _, counter := range mdtJobStatsCounters {
+					for _, counter := range ostJobStatsCounters {
 						if v, found := counters[counter]; found {
 							if strings.Contains(counter, "bytes") {
 								_, _ = fmt.Fprintf(w, "%13s", humanize.Bytes(v))
@@ -777,7 +827,7 @@ func httpStats(w http.ResponseWriter, _ *http.Request) {
 				}
 			}
 		} else {
-			_, _ = fmt.Fprint(w, "\nNo OST Jobstats available.")
+			_, _ = fmt.Fprintln(w, "No OST Jobstats available.")
 		}
 	}
 }
@@ -825,6 +875,28 @@ func jsonStats(w http.ResponseWriter, r *http.Request) {
 			} else {
 				w.WriteHeader(http.StatusNoContent)
 			}
+		case "info":
+			// Used by the web dashboard to find out what to poll and how often.
+			var info = map[string]interface{}{
+				"host":     currentSampleHost(),
+				"time":     sampleTime,
+				"interval": interval,
+				"client":   client,
+				"counters": map[string][]string{
+					"mdt":    mdtCounters,
+					"ost":    ostCounters,
+					"client": lliteCounters,
+					"mdtjob": mdtJobStatsCounters,
+					"ostjob": ostJobStatsCounters,
+				},
+			}
+			if aggregating {
+				info["down"] = agents.down()
+			}
+			jsonData, _ := json.Marshal(info)
+			_, _ = w.Write(jsonData)
+		default:
+			w.WriteHeader(http.StatusBadRequest)
 		}
 	} else {
 		w.WriteHeader(http.StatusBadRequest)
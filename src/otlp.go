@@ -0,0 +1,563 @@
+/*
+MIT License
+
+Copyright (c) 2020 storagebit.ch
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+// OpenTelemetry OTLP metrics exporter. To keep lure free of the rather large OpenTelemetry SDK, the few protobuf
+// messages needed for an ExportMetricsServiceRequest are encoded by hand, see
+// https://github.com/open-telemetry/opentelemetry-proto/blob/main/opentelemetry/proto/metrics/v1/metrics.proto
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+const (
+	otlpGRPCPath = "/opentelemetry.proto.collector.metrics.v1.MetricsService/Export"
+	otlpHTTPPath = "/v1/metrics"
+
+	otlpQueueLength = 16
+)
+
+var (
+	feedToOTLP        bool
+	otlpEndpoint      string
+	otlpProtocol      string
+	otlpInsecure      bool
+	otlpHeaders       string
+	otlpBatchSize     int
+	otlpFlushInterval time.Duration
+	otlpRetries       int
+	otlpRetryBackoff  time.Duration
+	otlpTimeout       time.Duration
+
+	otlpStartTime = time.Now()
+	otlpSeries    = make(map[string]*otlpSeriesState)
+	otlpLock      sync.Mutex
+	otlpPending   []otlpDataPoint
+	otlpBatches   = make(chan []otlpDataPoint, otlpQueueLength)
+	otlpClient    *http.Client
+	otlpTicker    *time.Ticker
+	otlpInFlight  int
+)
+
+// otlpDataPoint is a single value of a Sum or Gauge metric. Points sharing filesystem and metric name end up in
+// the same Metric message of the export request.
+type otlpDataPoint struct {
+	filesystem string
+	metric     string
+	unit       string
+	sum        bool
+	attributes [][2]string
+	value      uint64
+	timestamp  time.Time
+	startTime  time.Time // of cumulative sums
+}
+
+// otlpSeriesState is the start time of a cumulative sum and its last value. Lustre resets counters, e.g. when
+// a job is cleaned up and starts again, the sum then starts anew after its last data point.
+type otlpSeriesState struct {
+	start     time.Time
+	value     uint64
+	timestamp time.Time
+}
+
+// otlpSeriesTTL is how long the state of a series which isn't reported any more is kept.
+const otlpSeriesTTL = time.Hour
+
+// protoEncoder writes the protobuf wire format. Only the wire types used by the OTLP metric messages are
+// implemented.
+type protoEncoder struct {
+	buf []byte
+}
+
+func (p *protoEncoder) varint(v uint64) {
+	for v >= 0x80 {
+		p.buf = append(p.buf, byte(v)|0x80)
+		v >>= 7
+	}
+	p.buf = append(p.buf, byte(v))
+}
+
+func (p *protoEncoder) key(field int, wireType int) {
+	p.varint(uint64(field)<<3 | uint64(wireType))
+}
+
+func (p *protoEncoder) uint(field int, v uint64) {
+	p.key(field, 0)
+	p.varint(v)
+}
+
+func (p *protoEncoder) fixed64(field int, v uint64) {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], v)
+	p.key(field, 1)
+	p.buf = append(p.buf, b[:]...)
+}
+
+func (p *protoEncoder) bytes(field int, b []byte) {
+	p.key(field, 2)
+	p.varint(uint64(len(b)))
+	p.buf = append(p.buf, b...)
+}
+
+func (p *protoEncoder) string(field int, s string) {
+	if s != "" {
+		p.bytes(field, []byte(s))
+	}
+}
+
+func (p *protoEncoder) message(field int, m *protoEncoder) {
+	p.bytes(field, m.buf)
+}
+
+// keyValue encodes an opentelemetry.proto.common.v1.KeyValue with a string AnyValue.
+func (p *protoEncoder) keyValue(field int, key string, value string) {
+	var anyValue, kv protoEncoder
+	anyValue.string(1, value)
+	kv.string(1, key)
+	kv.message(2, &anyValue)
+	p.message(field, &kv)
+}
+
+// otlpMetricName maps a lure counter to the OTLP metric name, unit and op attribute. Byte counters become
+// <section>.bytes with op read or write, everything else <section>.operations with the counter as op.
+func otlpMetricName(statsType string, counter string) (string, string, string) {
+	var section = "lustre." + statsType
+	if strings.HasSuffix(statsType, "job") {
+		section = "lustre." + strings.TrimSuffix(statsType, "job") + ".job"
+	}
+	if strings.Contains(counter, "bytes") {
+		return section + ".bytes", "By", strings.TrimSuffix(counter, "_bytes")
+	}
+	return section + ".operations", "{operation}", counter
+}
+
+// otlpAddPoints queues the cumulative counter and the calculated rate of one device or job.
+func otlpAddPoints(statsType string, device string, job string, totals map[string]uint64, rates map[string]uint64,
+	slcCounters []string, timestamp time.Time) []otlpDataPoint {
+
+	var points []otlpDataPoint
+	var filesystem = strings.Split(device, "-")[0]
+
+	for _, counter := range slcCounters {
+		name, unit, op := otlpMetricName(statsType, counter)
+		var attributes = [][2]string{{"device", device}, {"op", op}}
+		if job != "" {
+			attributes = append(attributes, [2]string{"job", job})
+		}
+		if v, found := totals[counter]; found {
+			points = append(points, otlpSumPoint(otlpDataPoint{filesystem: filesystem, metric: name, unit: unit,
+				attributes: attributes, value: v, timestamp: timestamp}))
+		}
+		if v, found := rates[counter]; found {
+			points = append(points, otlpDataPoint{filesystem: filesystem, metric: name + ".rate", unit: unit + "/s",
+				attributes: attributes, value: v, timestamp: timestamp})
+		}
+	}
+	return points
+}
+
+func feedStatsToOTLP(mapTotals map[string]map[string]uint64, mapStats map[string]map[string]uint64,
+	slcDevices []string, slcCounters []string, statsType string) {
+
+	var points []otlpDataPoint
+	var timestamp = time.Now()
+
+	for _, device := range slcDevices {
+		points = append(points, otlpAddPoints(statsType, device, "", mapTotals[device], mapStats[device],
+			slcCounters, timestamp)...)
+	}
+	otlpQueue(points)
+}
+
+func feedJobStatsToOTLP(mapJobTotals map[string]map[string]map[string]uint64,
+	mapJobStats map[string]map[string]map[string]uint64, slcJobs []string, slcCounters []string, statsType string) {
+
+	var points []otlpDataPoint
+	var timestamp = time.Now()
+
+	for _, jobHash := range slcJobs {
+		var device = strings.Split(jobHash, "@@")[0]
+		var job = strings.Split(jobHash, "@@")[1]
+		points = append(points, otlpAddPoints(statsType, device, job, mapJobTotals[device][job],
+			mapJobStats[device][job], slcCounters, timestamp)...)
+	}
+	otlpQueue(points)
+}
+
+// feedSelfMetricsToOTLP sends lure's own metrics as lure.<counter> with the component as attribute, the sample
+// duration as gauge and everything else as cumulative sum. They belong to no filesystem.
+func feedSelfMetricsToOTLP(metrics map[string]map[string]uint64, slcComponents []string, slcCounters []string) {
+
+	var points []otlpDataPoint
+	var timestamp = time.Now()
+
+	for _, component := range slcComponents {
+		for _, counter := range slcCounters {
+			if v, found := metrics[component][counter]; found {
+				var unit = "1"
+				if strings.HasSuffix(counter, "_us") {
+					unit = "us"
+				}
+				var point = otlpDataPoint{metric: "lure." + counter, unit: unit,
+					attributes: [][2]string{{"component", component}}, value: v, timestamp: timestamp}
+				if !selfMetricGauges[counter] {
+					point = otlpSumPoint(point)
+				}
+				points = append(points, point)
+			}
+		}
+	}
+	otlpQueue(points)
+}
+
+// otlpSumPoint makes a point a cumulative sum with the start time of its series. A series starts with lure, a
+// value lower than the last one means the counter was reset and the series starts again after the last point.
+func otlpSumPoint(point otlpDataPoint) otlpDataPoint {
+	var key = point.filesystem + "\x00" + point.metric
+	for _, attribute := range point.attributes {
+		key += "\x00" + attribute[0] + "=" + attribute[1]
+	}
+
+	otlpLock.Lock()
+	defer otlpLock.Unlock()
+	var series = otlpSeries[key]
+	if series == nil {
+		series = &otlpSeriesState{start: otlpStartTime}
+		otlpSeries[key] = series
+	} else if point.value < series.value {
+		series.start = series.timestamp
+	}
+	series.value = point.value
+	series.timestamp = point.timestamp
+
+	point.sum = true
+	point.startTime = series.start
+	return point
+}
+
+// otlpForgetSeries drops the state of the series which weren't reported for otlpSeriesTTL.
+func otlpForgetSeries(now time.Time) {
+	otlpLock.Lock()
+	defer otlpLock.Unlock()
+	for key, series := range otlpSeries {
+		if now.Sub(series.timestamp) > otlpSeriesTTL {
+			delete(otlpSeries, key)
+		}
+	}
+}
+
+// otlpQueue adds the points to the pending batch and hands full batches over to the exporter.
+func otlpQueue(points []otlpDataPoint) {
+	otlpLock.Lock()
+	defer otlpLock.Unlock()
+
+	otlpPending = append(otlpPending, points...)
+	for len(otlpPending) >= otlpBatchSize {
+		otlpEnqueue(otlpPending[:otlpBatchSize])
+		otlpPending = otlpPending[otlpBatchSize:]
+	}
+}
+
+// otlpFlush hands whatever is pending over to the exporter.
+func otlpFlush() {
+	otlpLock.Lock()
+	defer otlpLock.Unlock()
+
+	if len(otlpPending) > 0 {
+		otlpEnqueue(otlpPending)
+		otlpPending = nil
+	}
+}
+
+// otlpEnqueue must be called with otlpLock held. If the collector can't keep up the batch is dropped rather
+// than blocking the sample loop.
+func otlpEnqueue(batch []otlpDataPoint) {
+	select {
+	case otlpBatches <- batch:
+		otlpInFlight++
+	default:
+		sinkFailed("otlp", fmt.Errorf("export queue full, dropping %d data points", len(batch)))
+	}
+}
+
+// startOTLPExporter sets up the client for the configured protocol and starts the background goroutines which
+// flush the pending batch every flush interval and send the batches to the collector. Called again after a
+// configuration reload it only replaces the client and the flush interval.
+func startOTLPExporter() {
+	var client *http.Client
+	if otlpProtocol == "grpc" {
+		var transport = &http2.Transport{}
+		if otlpInsecure {
+			// gRPC without TLS is HTTP/2 over cleartext (h2c).
+			transport.AllowHTTP = true
+			transport.DialTLS = func(network, addr string, _ *tls.Config) (net.Conn, error) {
+				return net.Dial(network, addr)
+			}
+		}
+		client = &http.Client{Transport: transport}
+	} else {
+		client = &http.Client{}
+	}
+
+	otlpLock.Lock()
+	defer otlpLock.Unlock()
+	otlpClient = client
+	if otlpTicker != nil {
+		otlpTicker.Reset(otlpFlushInterval)
+		return
+	}
+	otlpTicker = time.NewTicker(otlpFlushInterval)
+
+	go func() {
+		for range otlpTicker.C {
+			otlpFlush()
+		}
+	}()
+
+	go func() {
+		for batch := range otlpBatches {
+			otlpExport(batch)
+			otlpLock.Lock()
+			otlpInFlight--
+			otlpLock.Unlock()
+		}
+	}()
+}
+
+// otlpDrain sends the pending data points and waits until all batches are exported, or given up after their
+// retries, or until the context ends.
+func otlpDrain(ctx context.Context) error {
+	otlpFlush()
+	var ticker = time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		otlpLock.Lock()
+		var batches = otlpInFlight
+		otlpLock.Unlock()
+		if batches == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%d batches not sent: %v", batches, ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
+
+// otlpExport sends one batch, retrying with an exponential backoff as long as the error is not permanent.
+func otlpExport(batch []otlpDataPoint) {
+	var body = otlpEncodeRequest(batch)
+	var backoff = otlpRetryBackoff
+
+	for attempt := 0; ; attempt++ {
+		retryable, err := otlpSend(body)
+		if err == nil {
+			return
+		}
+		if !retryable || attempt >= otlpRetries {
+			sinkFailed("otlp", fmt.Errorf("export of %d data points failed: %v", len(batch), err))
+			return
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// otlpSend posts the encoded request and reports if a failure is worth retrying.
+func otlpSend(body []byte) (bool, error) {
+	var scheme = "https"
+	if otlpInsecure {
+		scheme = "http"
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), otlpTimeout)
+	defer cancel()
+
+	var req *http.Request
+	var err error
+	if otlpProtocol == "grpc" {
+		// gRPC length-prefixed message: compressed flag, 4 byte big endian length, message.
+		var frame = make([]byte, 5, 5+len(body))
+		binary.BigEndian.PutUint32(frame[1:], uint32(len(body)))
+		frame = append(frame, body...)
+		req, err = http.NewRequestWithContext(ctx, "POST", scheme+"://"+otlpEndpoint+otlpGRPCPath, bytes.NewReader(frame))
+		if err != nil {
+			return false, err
+		}
+		req.Header.Set("Content-Type", "application/grpc")
+		req.Header.Set("TE", "trailers")
+	} else {
+		req, err = http.NewRequestWithContext(ctx, "POST", scheme+"://"+otlpEndpoint+otlpHTTPPath, bytes.NewReader(body))
+		if err != nil {
+			return false, err
+		}
+		req.Header.Set("Content-Type", "application/x-protobuf")
+	}
+	for _, header := range strings.Split(otlpHeaders, ",") {
+		if name, value, found := strings.Cut(header, "="); found {
+			req.Header.Set(strings.TrimSpace(name), strings.TrimSpace(value))
+		}
+	}
+
+	otlpLock.Lock()
+	var client = otlpClient
+	otlpLock.Unlock()
+	resp, err := client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return true, err
+	}
+
+	if otlpProtocol == "grpc" {
+		if resp.StatusCode != http.StatusOK {
+			return otlpRetryableHTTPStatus(resp.StatusCode), fmt.Errorf("HTTP status %s", resp.Status)
+		}
+		// A failed call may come back as trailers-only response with the status in the headers.
+		var status = resp.Trailer.Get("grpc-status")
+		if status == "" {
+			status = resp.Header.Get("grpc-status")
+		}
+		var message = resp.Trailer.Get("grpc-message") + resp.Header.Get("grpc-message")
+		code, _ := strconv.Atoi(status)
+		if code != 0 {
+			return otlpRetryableGRPCStatus(code), fmt.Errorf("gRPC status %d: %s", code, message)
+		}
+		return false, nil
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return otlpRetryableHTTPStatus(resp.StatusCode), fmt.Errorf("HTTP status %s: %s", resp.Status,
+			strings.TrimSpace(string(respBody)))
+	}
+	return false, nil
+}
+
+// Retryable status codes as listed in the OTLP specification.
+func otlpRetryableHTTPStatus(code int) bool {
+	switch code {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+func otlpRetryableGRPCStatus(code int) bool {
+	switch code {
+	case 1, 4, 8, 10, 11, 14, 15: // CANCELLED, DEADLINE_EXCEEDED, RESOURCE_EXHAUSTED, ABORTED, OUT_OF_RANGE, UNAVAILABLE, DATA_LOSS
+		return true
+	}
+	return false
+}
+
+// otlpEncodeRequest builds an ExportMetricsServiceRequest with one ResourceMetrics per filesystem and one Metric
+// per metric name.
+func otlpEncodeRequest(batch []otlpDataPoint) []byte {
+	var mapFilesystems = make(map[string]map[string][]otlpDataPoint)
+	for _, point := range batch {
+		if _, found := mapFilesystems[point.filesystem]; !found {
+			mapFilesystems[point.filesystem] = make(map[string][]otlpDataPoint)
+		}
+		mapFilesystems[point.filesystem][point.metric] = append(mapFilesystems[point.filesystem][point.metric], point)
+	}
+
+	var slcFilesystems []string
+	for filesystem := range mapFilesystems {
+		slcFilesystems = append(slcFilesystems, filesystem)
+	}
+	sort.Strings(slcFilesystems)
+
+	var request protoEncoder
+	for _, filesystem := range slcFilesystems {
+		var resource, scope, scopeMetrics, resourceMetrics protoEncoder
+
+		resource.keyValue(1, "service.name", "lure")
+		resource.keyValue(1, "host.name", hostname)
+		if filesystem != "" {
+			resource.keyValue(1, "lustre.filesystem", filesystem)
+		}
+		resourceMetrics.message(1, &resource)
+
+		scope.string(1, "github.com/storagebit/lure")
+		scope.string(2, buildSha1)
+		scopeMetrics.message(1, &scope)
+
+		var slcMetrics []string
+		for metric := range mapFilesystems[filesystem] {
+			slcMetrics = append(slcMetrics, metric)
+		}
+		sort.Strings(slcMetrics)
+
+		for _, metric := range slcMetrics {
+			var points = mapFilesystems[filesystem][metric]
+			var metricMessage, data protoEncoder
+
+			metricMessage.string(1, metric)
+			metricMessage.string(3, points[0].unit)
+			for _, point := range points {
+				var dataPoint protoEncoder
+				for _, attribute := range point.attributes {
+					dataPoint.keyValue(7, attribute[0], attribute[1])
+				}
+				if point.sum {
+					dataPoint.fixed64(2, uint64(point.startTime.UnixNano()))
+				}
+				dataPoint.fixed64(3, uint64(point.timestamp.UnixNano()))
+				dataPoint.fixed64(6, point.value) // as_int
+				data.message(1, &dataPoint)
+			}
+			if points[0].sum {
+				data.uint(2, 2) // AGGREGATION_TEMPORALITY_CUMULATIVE
+				data.uint(3, 1) // is_monotonic
+				metricMessage.message(7, &data)
+			} else {
+				metricMessage.message(5, &data)
+			}
+			scopeMetrics.message(2, &metricMessage)
+		}
+		resourceMetrics.message(2, &scopeMetrics)
+		request.message(1, &resourceMetrics)
+	}
+	return request.buf
+}
@@ -0,0 +1,287 @@
+/*
+MIT License
+
+Copyright (c) 2020 storagebit.ch
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// protoField is one field of a decoded protobuf message, varint and fixed64 values are in value.
+type protoField struct {
+	number int
+	value  uint64
+	bytes  []byte
+}
+
+// protoDecode splits a message into its fields, it knows the wire types protoEncoder writes.
+func protoDecode(t *testing.T, b []byte) []protoField {
+	t.Helper()
+	var fields []protoField
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			t.Fatalf("invalid field key")
+		}
+		b = b[n:]
+		var field = protoField{number: int(key >> 3)}
+		switch key & 7 {
+		case 0:
+			field.value, n = binary.Uvarint(b)
+			if n <= 0 {
+				t.Fatalf("invalid varint in field %d", field.number)
+			}
+			b = b[n:]
+		case 1:
+			if len(b) < 8 {
+				t.Fatalf("short fixed64 in field %d", field.number)
+			}
+			field.value = binary.LittleEndian.Uint64(b)
+			b = b[8:]
+		case 2:
+			length, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < length {
+				t.Fatalf("invalid length in field %d", field.number)
+			}
+			field.bytes = b[n : n+int(length)]
+			b = b[n+int(length):]
+		default:
+			t.Fatalf("unexpected wire type %d in field %d", key&7, field.number)
+		}
+		fields = append(fields, field)
+	}
+	return fields
+}
+
+// otlpTestMetric is what the tests check of a decoded Metric message.
+type otlpTestMetric struct {
+	resource    map[string]string
+	name        string
+	sum         bool
+	temporality uint64
+	monotonic   uint64
+	startTimes  []uint64
+	values      []uint64
+}
+
+// otlpDecodeRequest decodes an ExportMetricsServiceRequest into its metrics, each with its resource attributes.
+func otlpDecodeRequest(t *testing.T, body []byte) []otlpTestMetric {
+	var keyValues = func(b []byte) (string, string) {
+		var key, value string
+		for _, field := range protoDecode(t, b) {
+			switch field.number {
+			case 1:
+				key = string(field.bytes)
+			case 2:
+				for _, anyValue := range protoDecode(t, field.bytes) {
+					value = string(anyValue.bytes)
+				}
+			}
+		}
+		return key, value
+	}
+
+	var metrics []otlpTestMetric
+	for _, resourceMetrics := range protoDecode(t, body) {
+		var resource = make(map[string]string)
+		for _, field := range protoDecode(t, resourceMetrics.bytes) {
+			switch field.number {
+			case 1:
+				for _, attribute := range protoDecode(t, field.bytes) {
+					key, value := keyValues(attribute.bytes)
+					resource[key] = value
+				}
+			case 2:
+				for _, scopeField := range protoDecode(t, field.bytes) {
+					if scopeField.number != 2 {
+						continue
+					}
+					var metric = otlpTestMetric{resource: resource}
+					for _, metricField := range protoDecode(t, scopeField.bytes) {
+						switch metricField.number {
+						case 1:
+							metric.name = string(metricField.bytes)
+						case 5, 7:
+							metric.sum = metricField.number == 7
+							for _, dataField := range protoDecode(t, metricField.bytes) {
+								switch dataField.number {
+								case 1:
+									for _, pointField := range protoDecode(t, dataField.bytes) {
+										switch pointField.number {
+										case 2:
+											metric.startTimes = append(metric.startTimes, pointField.value)
+										case 6:
+											metric.values = append(metric.values, pointField.value)
+										}
+									}
+								case 2:
+									metric.temporality = dataField.value
+								case 3:
+									metric.monotonic = dataField.value
+								}
+							}
+						}
+					}
+					metrics = append(metrics, metric)
+				}
+			}
+		}
+	}
+	return metrics
+}
+
+func otlpTestSetup(t *testing.T, protocol string, endpoint string) {
+	var saved = []interface{}{hostname, otlpProtocol, otlpEndpoint, otlpInsecure, otlpTimeout, otlpClient}
+	t.Cleanup(func() {
+		hostname, otlpProtocol, otlpEndpoint = saved[0].(string), saved[1].(string), saved[2].(string)
+		otlpInsecure, otlpTimeout, otlpClient = saved[3].(bool), saved[4].(time.Duration), saved[5].(*http.Client)
+	})
+	hostname, otlpProtocol, otlpEndpoint = "oss01", protocol, strings.TrimPrefix(endpoint, "http://")
+	otlpInsecure, otlpTimeout = true, 5*time.Second
+
+	if protocol == "grpc" {
+		otlpClient = &http.Client{Transport: &http2.Transport{AllowHTTP: true,
+			DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+				return net.Dial(network, addr)
+			}}}
+	} else {
+		otlpClient = &http.Client{}
+	}
+}
+
+// otlpTestPoints are the points of an OST with a byte counter.
+func otlpTestPoints(total uint64, timestamp time.Time) []otlpDataPoint {
+	return otlpAddPoints("ost", "testfs-OST0000", "", map[string]uint64{"write_bytes": total},
+		map[string]uint64{"write_bytes": 10}, []string{"write_bytes"}, timestamp)
+}
+
+func otlpCheckRequest(t *testing.T, body []byte) {
+	var metrics = otlpDecodeRequest(t, body)
+	if len(metrics) != 2 {
+		t.Fatalf("got %d metrics, want 2", len(metrics))
+	}
+	for _, metric := range metrics {
+		for key, want := range map[string]string{"service.name": "lure", "host.name": "oss01",
+			"lustre.filesystem": "testfs"} {
+			if metric.resource[key] != want {
+				t.Errorf("%s: resource attribute %s is %q, want %q", metric.name, key, metric.resource[key], want)
+			}
+		}
+	}
+	if sum := metrics[0]; sum.name != "lustre.ost.bytes" || !sum.sum || sum.temporality != 2 || sum.monotonic != 1 {
+		t.Errorf("got %+v, want the cumulative monotonic sum lustre.ost.bytes", sum)
+	}
+	if gauge := metrics[1]; gauge.name != "lustre.ost.bytes.rate" || gauge.sum || len(gauge.startTimes) != 0 {
+		t.Errorf("got %+v, want the gauge lustre.ost.bytes.rate", gauge)
+	}
+}
+
+func TestOTLPHTTP(t *testing.T) {
+	var bodies = make(chan []byte, 1)
+	var server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != otlpHTTPPath || r.Header.Get("Content-Type") != "application/x-protobuf" {
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies <- body
+	}))
+	defer server.Close()
+	otlpTestSetup(t, "http/protobuf", server.URL)
+
+	if _, err := otlpSend(otlpEncodeRequest(otlpTestPoints(100, time.Now()))); err != nil {
+		t.Fatal(err)
+	}
+	otlpCheckRequest(t, <-bodies)
+}
+
+func TestOTLPGRPC(t *testing.T) {
+	var bodies = make(chan []byte, 1)
+	var handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 || r.URL.Path != otlpGRPCPath || r.Header.Get("Content-Type") != "application/grpc" {
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+			return
+		}
+		frame, _ := ioutil.ReadAll(r.Body)
+		if len(frame) < 5 || int(binary.BigEndian.Uint32(frame[1:5])) != len(frame)-5 {
+			http.Error(w, "invalid gRPC frame", http.StatusBadRequest)
+			return
+		}
+		bodies <- frame[5:]
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "grpc-status")
+		w.WriteHeader(http.StatusOK)
+		w.Header().Set("grpc-status", "0")
+	})
+	var server = httptest.NewServer(h2c.NewHandler(handler, &http2.Server{}))
+	defer server.Close()
+	otlpTestSetup(t, "grpc", server.URL)
+
+	if _, err := otlpSend(otlpEncodeRequest(otlpTestPoints(100, time.Now()))); err != nil {
+		t.Fatal(err)
+	}
+	otlpCheckRequest(t, <-bodies)
+}
+
+func TestOTLPStartTimeReset(t *testing.T) {
+	otlpLock.Lock()
+	otlpSeries = make(map[string]*otlpSeriesState)
+	otlpLock.Unlock()
+
+	var first = time.Now()
+	var second, third = first.Add(5 * time.Second), first.Add(10 * time.Second)
+	var startTime = func(points []otlpDataPoint) time.Time {
+		return points[0].startTime
+	}
+
+	if got := startTime(otlpTestPoints(100, first)); !got.Equal(otlpStartTime) {
+		t.Errorf("first start time %v, want lure's start %v", got, otlpStartTime)
+	}
+	if got := startTime(otlpTestPoints(150, second)); !got.Equal(otlpStartTime) {
+		t.Errorf("start time %v moved without a reset", got)
+	}
+	// The counter went down, the series starts again after the last point.
+	if got := startTime(otlpTestPoints(20, third)); !got.Equal(second) {
+		t.Errorf("start time after the reset %v, want %v", got, second)
+	}
+
+	otlpForgetSeries(third.Add(otlpSeriesTTL + time.Second))
+	otlpLock.Lock()
+	var series = len(otlpSeries)
+	otlpLock.Unlock()
+	if series != 0 {
+		t.Errorf("%d series left after their TTL", series)
+	}
+}
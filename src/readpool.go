@@ -0,0 +1,188 @@
+/*
+MIT License
+
+Copyright (c) 2020 storagebit.ch
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	readWorkers int
+	readTimeout time.Duration
+
+	// readsInFlight holds the files whose read timed out and hasn't returned yet, with their collector. They
+	// aren't read again until it returns, so a hung target ties up one goroutine and not one per sample.
+	readsInFlight     = make(map[string]string)
+	readsInFlightLock sync.Mutex
+
+	// staleDevices holds the devices of each collector which couldn't be read in time in its last run.
+	staleDevices     = make(map[string][]string)
+	staleDevicesLock sync.Mutex
+)
+
+type readResult struct {
+	device   string
+	data     []byte
+	err      error
+	latency  time.Duration
+	timedOut bool
+}
+
+func addReadFlags(flags *flag.FlagSet) {
+	flags.IntVar(&readWorkers, "readworkers", 8, "Number of stats files read at the same time")
+	flags.DurationVar(&readTimeout, "readtimeout", 2*time.Second,
+		"Time a stats file read may take before the device is marked stale for the sample")
+}
+
+func validateReadOptions() error {
+	if readWorkers < 1 {
+		return fmt.Errorf("the -readworkers must be at least one")
+	}
+	if readTimeout <= 0 {
+		return fmt.Errorf("the -readtimeout must be greater than zero")
+	}
+	return nil
+}
+
+// readFiles reads the files of a collector by device, at most -readworkers at the same time. A device whose
+// read takes longer than -readtimeout, or whose read of an earlier sample still hangs, is left out and marked
+// stale. The latency of every read is kept as self metric of the file, e.g. file.ost.testfs-OST0000.
+func readFiles(collector string, files map[string]string) map[string][]byte {
+	var mapRaw = make(map[string][]byte)
+	var stale []string
+	var results = make(chan readResult, len(files))
+	var slots = make(chan struct{}, readWorkers)
+	var started int
+
+	forgetGoneFiles(collector, files)
+	for device, path := range files {
+		readsInFlightLock.Lock()
+		var _, hanging = readsInFlight[path]
+		readsInFlightLock.Unlock()
+		if hanging {
+			logWarn("stats file still being read, device is stale", "collector", collector, "device", device)
+			stale = append(stale, device)
+			continue
+		}
+		started++
+		go func(device string, path string) {
+			slots <- struct{}{}
+			defer func() { <-slots }()
+			results <- readWithTimeout(collector, device, path)
+		}(device, path)
+	}
+
+	var filesRead uint64
+	for i := 0; i < started; i++ {
+		var result = <-results
+		var component = "file." + collector + "." + result.device
+		switch {
+		case result.timedOut:
+			lureMetrics.add("collector."+collector, "read_timeouts", 1)
+			lureMetrics.set(component, "read_latency_us", uint64(result.latency.Microseconds()))
+			logWarn("reading stats file timed out, device is stale", "collector", collector, "device",
+				result.device, "timeout", readTimeout)
+			stale = append(stale, result.device)
+		case result.err != nil:
+			lureMetrics.add("collector."+collector, "read_errors", 1)
+			logError("reading stats file failed", "collector", collector, "device", result.device, "error",
+				result.err)
+		default:
+			lureMetrics.set(component, "read_latency_us", uint64(result.latency.Microseconds()))
+			mapRaw[result.device] = result.data
+			filesRead++
+		}
+	}
+	lureMetrics.add("collector."+collector, "files_read", filesRead)
+
+	sort.Strings(stale)
+	staleDevicesLock.Lock()
+	staleDevices[collector] = stale
+	staleDevicesLock.Unlock()
+	return mapRaw
+}
+
+// readWithTimeout reads a file, giving up after -readtimeout. A read of /proc can't be interrupted, a read
+// which timed out goes on in the background and is marked in readsInFlight until it returns.
+func readWithTimeout(collector string, device string, path string) readResult {
+	var start = time.Now()
+	var done = make(chan readResult, 1)
+	var returned bool // guarded by readsInFlightLock
+
+	go func() {
+		data, err := ioutil.ReadFile(path)
+		readsInFlightLock.Lock()
+		returned = true
+		delete(readsInFlight, path)
+		readsInFlightLock.Unlock()
+		done <- readResult{device: device, data: data, err: err, latency: time.Since(start)}
+	}()
+
+	var timer = time.NewTimer(readTimeout)
+	defer timer.Stop()
+	select {
+	case result := <-done:
+		return result
+	case <-timer.C:
+		readsInFlightLock.Lock()
+		if !returned {
+			readsInFlight[path] = collector
+		}
+		readsInFlightLock.Unlock()
+		return readResult{device: device, latency: time.Since(start), timedOut: true}
+	}
+}
+
+// forgetGoneFiles drops the hanging reads and the file self metrics of devices the collector doesn't have any
+// more, e.g. an unmounted target.
+func forgetGoneFiles(collector string, files map[string]string) {
+	var paths = make(map[string]bool)
+	var components = make(map[string]bool)
+	for device, path := range files {
+		paths[path] = true
+		components["file."+collector+"."+device] = true
+	}
+
+	readsInFlightLock.Lock()
+	for path, owner := range readsInFlight {
+		if owner == collector && !paths[path] {
+			delete(readsInFlight, path)
+		}
+	}
+	readsInFlightLock.Unlock()
+	lureMetrics.forget("file."+collector+".", components)
+}
+
+// staleDevicesOf returns the devices of a collector which couldn't be read in its last run.
+func staleDevicesOf(collector string) []string {
+	staleDevicesLock.Lock()
+	defer staleDevicesLock.Unlock()
+	return staleDevices[collector]
+}
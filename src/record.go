@@ -0,0 +1,330 @@
+/*
+MIT License
+
+Copyright (c) 2020 storagebit.ch
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const recordTimeFormat = "20060102T150405"
+
+var (
+	recordDir       string
+	recordFormat    string
+	recordMaxSize   int64
+	recordMaxAge    time.Duration
+	recordRetention int
+
+	recordFile     *os.File
+	recordSize     int64
+	recordOpened   time.Time
+	recordCompress sync.Mutex
+)
+
+// statsSample holds all stats calculated during one sample interval. It is the unit written to the recording
+// files, one JSON object per line in the ndjson format.
+type statsSample struct {
+	Time     time.Time                               `json:"time"`
+	Host     string                                  `json:"host"`
+	Interval int                                     `json:"interval"`
+	MDT      map[string]map[string]uint64            `json:"mdt,omitempty"`
+	OST      map[string]map[string]uint64            `json:"ost,omitempty"`
+	Client   map[string]map[string]uint64            `json:"client,omitempty"`
+	MDTJob   map[string]map[string]map[string]uint64 `json:"mdtjob,omitempty"`
+	OSTJob   map[string]map[string]map[string]uint64 `json:"ostjob,omitempty"`
+	Self     map[string]map[string]uint64            `json:"self,omitempty"`
+}
+
+var csvHeader = []string{"time", "host", "interval", "stats", "device", "job", "counter", "value"}
+
+// currentSample collects the latest calculated stats.
+func currentSample() statsSample {
+	return statsSample{
+		Time:     sampleTime,
+		Host:     currentSampleHost(),
+		Interval: interval,
+		MDT:      mapMDTCalcStats,
+		OST:      mapOSTCalcStats,
+		Client:   mapLliteCalcStats,
+		MDTJob:   mapMDTJobStats,
+		OSTJob:   mapOSTJobStats,
+	}
+}
+
+// recordFileName returns the name of the file currently written to.
+func recordFileName() string {
+	return filepath.Join(recordDir, "lure-"+hostname+"."+recordFormat)
+}
+
+// openRecordFile opens or continues the current recording file. A new CSV file starts with the header line.
+func openRecordFile() error {
+	file, err := os.OpenFile(recordFileName(), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	recordFile = file
+	recordSize = info.Size()
+	recordOpened = time.Now()
+
+	if recordFormat == "csv" && recordSize == 0 {
+		var line strings.Builder
+		w := csv.NewWriter(&line)
+		_ = w.Write(csvHeader)
+		w.Flush()
+		n, err := recordFile.WriteString(line.String())
+		recordSize += int64(n)
+		return err
+	}
+	return nil
+}
+
+// closeRecordFile closes the current file without rotating it, the next sample opens the file again, e.g. in
+// another directory after a configuration reload.
+func closeRecordFile() error {
+	if recordFile == nil {
+		return nil
+	}
+	err := recordFile.Close()
+	recordFile = nil
+	return err
+}
+
+// rotateRecordFile closes the current file and renames it after the time it was opened. Compression and the
+// retention clean up run in the background to not delay the sample loop.
+func rotateRecordFile() error {
+	if err := recordFile.Close(); err != nil {
+		return err
+	}
+	recordFile = nil
+
+	rotated := rotatedRecordFileName()
+	if err := os.Rename(recordFileName(), rotated); err != nil {
+		return err
+	}
+
+	go func() {
+		recordCompress.Lock()
+		defer recordCompress.Unlock()
+		if err := gzipFile(rotated); err != nil {
+			sinkFailed("record", fmt.Errorf("compressing %s: %v", rotated, err))
+		}
+		if err := cleanupRecordFiles(); err != nil {
+			sinkFailed("record", fmt.Errorf("removing expired recordings: %v", err))
+		}
+	}()
+	return nil
+}
+
+// rotatedRecordFileName names a rotated file after the time it was opened. Files opened within the same second
+// get a counter, e.g. lure-oss01-20201104T101500-1.ndjson, a rename must not overwrite another recording.
+func rotatedRecordFileName() string {
+	var name = "lure-" + hostname + "-" + recordOpened.Format(recordTimeFormat)
+	for i := 1; ; i++ {
+		var rotated = filepath.Join(recordDir, name+"."+recordFormat)
+		if !fileExists(rotated) && !fileExists(rotated+".gz") {
+			return rotated
+		}
+		name = "lure-" + hostname + "-" + recordOpened.Format(recordTimeFormat) + "-" + strconv.Itoa(i)
+	}
+}
+
+func fileExists(path string) bool {
+	_, err := os.Lstat(path)
+	return err == nil
+}
+
+// gzipFile compresses the file into file.gz and removes the original.
+func gzipFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(path + ".gz")
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	if _, err = io.Copy(zw, in); err == nil {
+		err = zw.Close()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path + ".gz")
+		return err
+	}
+	return os.Remove(path)
+}
+
+// cleanupRecordFiles removes the oldest rotated files beyond the retention limit.
+func cleanupRecordFiles() error {
+	files, err := ioutil.ReadDir(recordDir)
+	if err != nil {
+		return err
+	}
+	// Only rotated files of this host and format, e.g. lure-oss01-20201104T101500-1.ndjson.gz, nothing else
+	// which happens to be in the directory.
+	var pattern = regexp.MustCompile(`^lure-` + regexp.QuoteMeta(hostname) + `-(\d{8}T\d{6})(?:-(\d+))?\.` +
+		regexp.QuoteMeta(recordFormat) + `\.gz$`)
+	var rotated []string
+	var order = make(map[string]string)
+	for _, file := range files {
+		if match := pattern.FindStringSubmatch(file.Name()); match != nil {
+			rotated = append(rotated, file.Name())
+			// The timestamp and the counter sort the files from oldest to newest.
+			counter, _ := strconv.Atoi(match[2])
+			order[file.Name()] = fmt.Sprintf("%s-%09d", match[1], counter)
+		}
+	}
+	sort.Slice(rotated, func(i, j int) bool { return order[rotated[i]] < order[rotated[j]] })
+	for len(rotated) > recordRetention {
+		logInfo("removing expired recording", "file", rotated[0])
+		if err := os.Remove(filepath.Join(recordDir, rotated[0])); err != nil {
+			return err
+		}
+		rotated = rotated[1:]
+	}
+	return nil
+}
+
+// recordSample appends the sample to the current recording file and rotates the file once it reaches the
+// maximum size or age.
+func recordSample(sample statsSample) error {
+	if recordFile != nil && (recordSize >= recordMaxSize*1024*1024 || time.Since(recordOpened) >= recordMaxAge) {
+		if err := rotateRecordFile(); err != nil {
+			sinkFailed("record", fmt.Errorf("rotating recording file: %v", err))
+		}
+	}
+	if recordFile == nil {
+		if err := openRecordFile(); err != nil {
+			return fmt.Errorf("opening recording file: %v", err)
+		}
+	}
+
+	var data []byte
+	if recordFormat == "csv" {
+		data = encodeSampleCSV(sample, ',')
+	} else {
+		jsonData, err := json.Marshal(sample)
+		if err != nil {
+			return fmt.Errorf("encoding sample: %v", err)
+		}
+		data = append(jsonData, '\n')
+	}
+
+	n, err := recordFile.Write(data)
+	recordSize += int64(n)
+	return err
+}
+
+// encodeSampleCSV writes one line per counter, which keeps the file usable with awk, cut and friends. The comma
+// is ',' for CSV and '\t' for TSV.
+func encodeSampleCSV(sample statsSample, comma rune) []byte {
+	var buf strings.Builder
+	w := csv.NewWriter(&buf)
+	w.Comma = comma
+	var timestamp = sample.Time.Format(time.RFC3339Nano)
+	var strInterval = strconv.Itoa(sample.Interval)
+
+	writeStats := func(statsType string, mapStats map[string]map[string]uint64) {
+		for _, device := range sortStatsMapIntoSlice(mapStats) {
+			for _, counter := range sortedCounters(mapStats[device]) {
+				_ = w.Write([]string{timestamp, sample.Host, strInterval, statsType, device, "", counter,
+					strconv.FormatUint(mapStats[device][counter], 10)})
+			}
+		}
+	}
+	writeJobStats := func(statsType string, mapJobStats map[string]map[string]map[string]uint64) {
+		for _, jobHash := range sortJobsMapIntoSlice(mapJobStats) {
+			var device = strings.Split(jobHash, "@@")[0]
+			var job = strings.Split(jobHash, "@@")[1]
+			for _, counter := range sortedCounters(mapJobStats[device][job]) {
+				_ = w.Write([]string{timestamp, sample.Host, strInterval, statsType, device, job, counter,
+					strconv.FormatUint(mapJobStats[device][job][counter], 10)})
+			}
+		}
+	}
+
+	writeStats("mdt", sample.MDT)
+	writeStats("ost", sample.OST)
+	writeStats("client", sample.Client)
+	writeJobStats("mdtjob", sample.MDTJob)
+	writeJobStats("ostjob", sample.OSTJob)
+	writeStats("self", sample.Self)
+	w.Flush()
+	return []byte(buf.String())
+}
+
+func sortedCounters(counters map[string]uint64) []string {
+	var slcCounters []string
+	for counter := range counters {
+		slcCounters = append(slcCounters, counter)
+	}
+	sort.Strings(slcCounters)
+	return slcCounters
+}
+
+// startRecording validates the recording options and creates the directory.
+func startRecording() error {
+	if err := validateRecordOptions(); err != nil {
+		return err
+	}
+	return os.MkdirAll(recordDir, 0755)
+}
+
+// validateRecordOptions checks the recording flags.
+func validateRecordOptions() error {
+	if recordFormat != "ndjson" && recordFormat != "csv" {
+		return fmt.Errorf("invalid recording format %q, use ndjson or csv", recordFormat)
+	}
+	if recordMaxSize < 1 || recordMaxAge <= 0 {
+		return fmt.Errorf("the recording size and age limits must be greater than zero")
+	}
+	if recordRetention < 1 {
+		return fmt.Errorf("the -recordretention must keep at least one rotated file")
+	}
+	return nil
+}
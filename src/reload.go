@@ -0,0 +1,199 @@
+/*
+MIT License
+
+Copyright (c) 2020 storagebit.ch
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// A reload reads the configuration file and the web interface certificate and credentials again. It is triggered
+// by SIGHUP or POST /api/v1/reload. The lure agent applies it in the sample loop between two samples, so a
+// sample never sees half of the old and half of the new configuration and no sample is lost.
+var reloadRequests = make(chan chan error)
+
+// reloadInSampleLoop is set by the lure agent, replay and aggregate only reload the web interface files.
+var reloadInSampleLoop bool
+
+var reloadHandler sync.Once
+
+// restartFlags can't be changed at runtime, lure logs that they only take effect after a restart.
+var restartFlags = map[string]bool{"port": true, "listen": true, "nohttp": true, "daemon": true, "batch": true}
+
+// startReloadHandler reloads on every SIGHUP.
+func startReloadHandler() {
+	reloadHandler.Do(func() {
+		var signals = make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGHUP)
+		go func() {
+			for range signals {
+				_ = reload()
+			}
+		}()
+	})
+}
+
+// reload hands the reload over to the sample loop and waits for the outcome, which is logged either way.
+func reload() error {
+	if !reloadInSampleLoop {
+		return reloadWebSecurity()
+	}
+	var reply = make(chan error, 1)
+	reloadRequests <- reply
+	return <-reply
+}
+
+// reloadWebSecurity reads the certificate and credential files of the web interface again.
+func reloadWebSecurity() error {
+	if !httpStarted {
+		return nil
+	}
+	if err := httpSecurity.load(); err != nil {
+		logError("reloading web interface certificate and credentials failed", "error", err)
+		return fmt.Errorf("reloading web interface certificate and credentials: %v", err)
+	}
+	logInfo("reloaded web interface certificate and credentials")
+	return nil
+}
+
+// reloadConfig reads the -config file again and applies what changed. A file which doesn't validate is
+// rejected as a whole, lure keeps running with the previous configuration.
+func reloadConfig() error {
+	if configFile == "" {
+		return reloadWebSecurity()
+	}
+
+	var before = configFlagValues(flag.CommandLine)
+	err := loadConfig(configFile, flag.CommandLine)
+	if err == nil {
+		err = validateOptions()
+	}
+	if err != nil {
+		for name, value := range before {
+			_ = flag.CommandLine.Set(name, value)
+		}
+		_ = setupCounters()
+		_ = setupCollectors()
+		_ = setupJobIDs()
+		logError("reloading the configuration failed, keeping the previous configuration", "file", configFile,
+			"error", err)
+		return err
+	}
+
+	var after = configFlagValues(flag.CommandLine)
+	var changed []string
+	var restart []string
+	var switchedTLS bool
+	for name, value := range after {
+		if before[name] == value {
+			continue
+		}
+		changed = append(changed, name)
+		if name == "tlscert" && (before[name] == "") != (value == "") {
+			switchedTLS = true
+		}
+		if restartFlags[name] || (name == "tlscert" && switchedTLS) {
+			restart = append(restart, name)
+		}
+	}
+	sort.Strings(changed)
+	sort.Strings(restart)
+	var isChanged = func(prefixes ...string) bool {
+		for _, name := range changed {
+			for _, prefix := range prefixes {
+				if strings.HasPrefix(name, prefix) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	if isChanged("log") {
+		checkContinue(setupLogging())
+	}
+	if isChanged("history") {
+		checkContinue(history.resize(historyTiers, historyMaxMem))
+	}
+	if isChanged("otlp", "feedtootlp") && feedToOTLP {
+		startOTLPExporter()
+	}
+	if isChanged("record") {
+		checkContinue(closeRecordFile())
+		if recordDir != "" {
+			checkContinue(startRecording())
+		}
+	}
+	// New targets may have been mounted since the last discovery, so the devices are looked up every time.
+	discoverDevices()
+	// The listeners keep serving HTTP or HTTPS until the restart, so they keep the certificate they have.
+	if switchedTLS {
+		logWarn("web interface certificate and credentials not reloaded, switching HTTPS on or off requires a restart")
+	} else {
+		err = reloadWebSecurity()
+	}
+
+	if len(changed) == 0 {
+		logInfo("reloaded the configuration, nothing changed", "file", configFile)
+	} else {
+		logInfo("reloaded the configuration", "file", configFile, "changed", strings.Join(changed, ","))
+	}
+	if len(restart) > 0 {
+		logWarn("changed settings require a restart of lure", "flags", strings.Join(restart, ","))
+	}
+	return err
+}
+
+// configFlagValues returns the current values of all flags which can be set in the configuration file.
+func configFlagValues(flags *flag.FlagSet) map[string]string {
+	var values = make(map[string]string)
+	for _, key := range configKeys {
+		values[key.flag] = flags.Lookup(key.flag).Value.String()
+	}
+	return values
+}
+
+// apiReload serves POST /api/v1/reload. It waits for the next sample, at most one interval.
+func apiReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		apiError(w, http.StatusMethodNotAllowed, "use POST to reload the configuration")
+		return
+	}
+	if err := reload(); err != nil {
+		apiError(w, http.StatusUnprocessableEntity, "%v", err)
+		return
+	}
+	apiWrite(w, http.StatusOK, apiEnvelope{Timestamp: time.Now(), Host: hostname, Interval: interval,
+		Data: map[string]string{"config": configFile}})
+}
@@ -0,0 +1,525 @@
+/*
+MIT License
+
+Copyright (c) 2020 storagebit.ch
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	tm "github.com/buger/goterm"
+)
+
+// replayer plays recorded samples back through the console and web interface.
+type replayer struct {
+	sync.Mutex
+	samples  []statsSample
+	position int
+	paused   bool
+	speed    float64
+	wake     chan struct{}
+	quit     chan struct{}
+}
+
+// parseReplayTime accepts RFC3339 or a local "2006-01-02 15:04:05" time stamp.
+func parseReplayTime(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.ParseInLocation("2006-01-02 15:04:05", value, time.Local)
+}
+
+// loadSamples reads a recording written with -record. Gzip compressed files and both the ndjson and the CSV
+// format are detected automatically. Samples outside of from and to are skipped.
+func loadSamples(path string, from time.Time, to time.Time) ([]statsSample, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var reader io.Reader = file
+	if strings.HasSuffix(path, ".gz") {
+		zr, err := gzip.NewReader(file)
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		reader = zr
+	}
+
+	buffered := bufio.NewReader(reader)
+	first, err := buffered.Peek(1)
+	if err != nil {
+		return nil, fmt.Errorf("%s: empty recording", path)
+	}
+
+	var samples []statsSample
+	if first[0] == '{' {
+		samples, err = loadSamplesNDJSON(buffered)
+	} else {
+		samples, err = loadSamplesCSV(buffered)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	var filtered []statsSample
+	for _, sample := range samples {
+		if (!from.IsZero() && sample.Time.Before(from)) || (!to.IsZero() && sample.Time.After(to)) {
+			continue
+		}
+		filtered = append(filtered, sample)
+	}
+	return filtered, nil
+}
+
+func loadSamplesNDJSON(reader io.Reader) ([]statsSample, error) {
+	var samples []statsSample
+	decoder := json.NewDecoder(reader)
+	for {
+		var sample statsSample
+		if err := decoder.Decode(&sample); err == io.EOF {
+			return samples, nil
+		} else if err != nil {
+			return nil, err
+		}
+		samples = append(samples, sample)
+	}
+}
+
+// loadSamplesCSV folds the per counter lines back into samples, all lines with the same time stamp belong to
+// the same sample.
+func loadSamplesCSV(reader io.Reader) ([]statsSample, error) {
+	var samples []statsSample
+	r := csv.NewReader(reader)
+	r.FieldsPerRecord = len(csvHeader)
+
+	header, err := r.Read()
+	if err != nil {
+		return nil, err
+	}
+	if strings.Join(header, ",") != strings.Join(csvHeader, ",") {
+		return nil, errors.New("unknown CSV header")
+	}
+
+	var lastTime string
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			return samples, nil
+		} else if err != nil {
+			return nil, err
+		}
+		if record[0] != lastTime {
+			timestamp, err := time.Parse(time.RFC3339Nano, record[0])
+			if err != nil {
+				return nil, err
+			}
+			sampleInterval, _ := strconv.Atoi(record[2])
+			samples = append(samples, statsSample{Time: timestamp, Host: record[1], Interval: sampleInterval})
+			lastTime = record[0]
+		}
+		var sample = &samples[len(samples)-1]
+		value, err := strconv.ParseUint(record[7], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		var statsType, device, job, counter = record[3], record[4], record[5], record[6]
+
+		switch statsType {
+		case "mdt":
+			sample.MDT = addSampleValue(sample.MDT, device, counter, value)
+		case "ost":
+			sample.OST = addSampleValue(sample.OST, device, counter, value)
+		case "client":
+			sample.Client = addSampleValue(sample.Client, device, counter, value)
+		case "mdtjob":
+			sample.MDTJob = addSampleJobValue(sample.MDTJob, device, job, counter, value)
+		case "ostjob":
+			sample.OSTJob = addSampleJobValue(sample.OSTJob, device, job, counter, value)
+		}
+	}
+}
+
+func addSampleValue(mapStats map[string]map[string]uint64, device string, counter string,
+	value uint64) map[string]map[string]uint64 {
+
+	if mapStats == nil {
+		mapStats = make(map[string]map[string]uint64)
+	}
+	if mapStats[device] == nil {
+		mapStats[device] = make(map[string]uint64)
+	}
+	mapStats[device][counter] = value
+	return mapStats
+}
+
+func addSampleJobValue(mapJobStats map[string]map[string]map[string]uint64, device string, job string,
+	counter string, value uint64) map[string]map[string]map[string]uint64 {
+
+	if mapJobStats == nil {
+		mapJobStats = make(map[string]map[string]map[string]uint64)
+	}
+	mapJobStats[device] = addSampleValue(mapJobStats[device], job, counter, value)
+	return mapJobStats
+}
+
+// sampleHost is the host of the replayed or aggregated sample, e.g. "cluster, 3 of 4 agents". hostname stays
+// the host lure runs on, the sinks and the API envelopes use it.
+var sampleHost atomic.Value
+
+// currentSampleHost returns the host the current sample is from, the console and the dashboard show it.
+func currentSampleHost() string {
+	if host, ok := sampleHost.Load().(string); ok && host != "" {
+		return host
+	}
+	return hostname
+}
+
+// applySample makes a sample the current one, the console and the web interface show it just like the result
+// of a live sample.
+func applySample(sample statsSample) {
+	updateDiscoveredCounters(sample)
+	sampleTime = sample.Time
+	sampleHost.Store(sample.Host)
+	interval = sample.Interval
+
+	mapMDTCalcStats = sample.MDT
+	mapOSTCalcStats = sample.OST
+	mapLliteCalcStats = sample.Client
+	mapMDTJobStats = sample.MDTJob
+	mapOSTJobStats = sample.OSTJob
+	client = len(sample.Client) > 0
+
+	sortedMTDDevices = sortStatsMapIntoSlice(mapMDTCalcStats)
+	sortedOSTDevices = sortStatsMapIntoSlice(mapOSTCalcStats)
+	sortedLliteFilesystems = sortStatsMapIntoSlice(mapLliteCalcStats)
+	sortedMDTJobs = sortJobsMapIntoSlice(mapMDTJobStats)
+	sortedOSTJobs = sortJobsMapIntoSlice(mapOSTJobStats)
+}
+
+// control changes the playback. It is used by the keyboard as well as the /replay HTTP handler.
+func (r *replayer) control(action string, value string) error {
+	r.Lock()
+	defer r.Unlock()
+
+	switch action {
+	case "play":
+		r.paused = false
+	case "pause":
+		r.paused = true
+	case "toggle":
+		r.paused = !r.paused
+	case "faster":
+		if r.speed < 64 {
+			r.speed *= 2
+		}
+	case "slower":
+		if r.speed > 1.0/64 {
+			r.speed /= 2
+		}
+	case "speed":
+		speed, err := strconv.ParseFloat(value, 64)
+		if err != nil || speed <= 0 {
+			return fmt.Errorf("invalid speed %q", value)
+		}
+		r.speed = speed
+	case "step":
+		// A relative number of samples, e.g. -10 or +1.
+		step, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid step %q", value)
+		}
+		r.seek(r.position + step)
+	case "seek":
+		// An absolute time stamp, the first sample at or after it is shown.
+		t, err := parseReplayTime(value)
+		if err != nil {
+			return fmt.Errorf("invalid time %q", value)
+		}
+		var position = len(r.samples) - 1
+		for i, sample := range r.samples {
+			if !sample.Time.Before(t) {
+				position = i
+				break
+			}
+		}
+		r.seek(position)
+	default:
+		return fmt.Errorf("unknown action %q", action)
+	}
+
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// seek must be called with the lock held.
+func (r *replayer) seek(position int) {
+	if position < 0 {
+		position = 0
+	}
+	if position > len(r.samples)-1 {
+		position = len(r.samples) - 1
+	}
+	r.position = position
+}
+
+// delay is the time to wait before the next sample, which is the recorded time between both samples divided by
+// the playback speed. Gaps in the recording, e.g. while lure was not running, are skipped.
+func (r *replayer) delay() time.Duration {
+	var current = r.samples[r.position]
+	var gap = time.Duration(current.Interval) * time.Second
+	if r.position+1 < len(r.samples) {
+		var next = r.samples[r.position+1].Time.Sub(current.Time)
+		if next > 0 && next <= 10*gap {
+			gap = next
+		}
+	}
+	if gap <= 0 {
+		gap = time.Second
+	}
+	return time.Duration(float64(gap) / r.speed)
+}
+
+// render shows the current sample and the playback state on the console.
+func (r *replayer) render(console bool) {
+	r.Lock()
+	var sample = r.samples[r.position]
+	var status = fmt.Sprintf("Replay: sample %d/%d | Speed: %gx", r.position+1, len(r.samples), r.speed)
+	if r.paused {
+		status += " | PAUSED"
+	}
+	r.Unlock()
+
+	// Pausing or changing the speed renders the same sample again, stream subscribers only get new ones.
+	if !sample.Time.Equal(sampleTime) {
+		streams.publish(sample)
+	}
+	applySample(sample)
+	if console {
+		printConsole()
+		fmt.Println()
+		fmt.Println(tm.Background(tm.Color(tm.Bold(status), tm.BLACK), tm.CYAN))
+		fmt.Println("[space] play/pause  [+/-] speed  [left/right] step  [up/down] jump 10%  [g/G] start/end  [q] quit")
+	}
+}
+
+// run plays the samples until the user quits. Playback stops at the last sample, seeking back is still possible.
+func (r *replayer) run(console bool) {
+	for {
+		r.render(console)
+
+		r.Lock()
+		var wait = r.delay()
+		var paused = r.paused
+		r.Unlock()
+
+		var timer <-chan time.Time
+		if !paused {
+			timer = time.After(wait)
+		}
+		select {
+		case <-r.quit:
+			return
+		case <-r.wake:
+		case <-timer:
+			r.Lock()
+			if r.position < len(r.samples)-1 {
+				r.position++
+			} else {
+				r.paused = true
+			}
+			r.Unlock()
+		}
+	}
+}
+
+// readKeys translates key presses into playback controls.
+func (r *replayer) readKeys() {
+	var jump = len(r.samples) / 10
+	if jump < 1 {
+		jump = 1
+	}
+	reader := bufio.NewReader(os.Stdin)
+	for {
+		key, err := reader.ReadByte()
+		if err != nil {
+			return
+		}
+		switch key {
+		case ' ':
+			_ = r.control("toggle", "")
+		case '+':
+			_ = r.control("faster", "")
+		case '-':
+			_ = r.control("slower", "")
+		case 'g':
+			_ = r.control("step", strconv.Itoa(-len(r.samples)))
+		case 'G':
+			_ = r.control("step", strconv.Itoa(len(r.samples)))
+		case 'q':
+			close(r.quit)
+			return
+		case 0x1b:
+			// Arrow keys are sent as ESC [ A to D.
+			if next, _ := reader.ReadByte(); next != '[' {
+				continue
+			}
+			arrow, _ := reader.ReadByte()
+			switch arrow {
+			case 'A':
+				_ = r.control("step", strconv.Itoa(jump))
+			case 'B':
+				_ = r.control("step", strconv.Itoa(-jump))
+			case 'C':
+				_ = r.control("step", "1")
+			case 'D':
+				_ = r.control("step", "-1")
+			}
+		}
+	}
+}
+
+// httpReplay controls the playback via the web interface, e.g. /replay?action=seek&value=2020-11-04T10:15:00Z
+func (r *replayer) httpReplay(w http.ResponseWriter, req *http.Request) {
+	var action = req.URL.Query().Get("action")
+	if action != "" {
+		if err := r.control(action, req.URL.Query().Get("value")); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	r.Lock()
+	defer r.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	jsonData, _ := json.Marshal(map[string]interface{}{
+		"position": r.position,
+		"samples":  len(r.samples),
+		"time":     r.samples[r.position].Time,
+		"from":     r.samples[0].Time,
+		"to":       r.samples[len(r.samples)-1].Time,
+		"speed":    r.speed,
+		"paused":   r.paused,
+	})
+	_, _ = w.Write(jsonData)
+}
+
+// runReplay implements "lure replay [options] <file>".
+func runReplay(args []string) {
+	var speed float64
+	var strFrom, strTo string
+	var daemon bool
+
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s replay [options] <recording file>\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	addHTTPFlags(flags)
+	addJobFlags(flags)
+	addJobIDFlags(flags)
+	addCounterFlags(flags)
+	addLogFlags(flags)
+	flags.Float64Var(&speed, "speed", 1, "Playback speed, 2 plays twice as fast as recorded.")
+	flags.StringVar(&strFrom, "from", "", "Skip samples before this time, RFC3339 or \"2006-01-02 15:04:05\".")
+	flags.StringVar(&strTo, "to", "", "Skip samples after this time, RFC3339 or \"2006-01-02 15:04:05\".")
+	flags.BoolVar(&daemon, "daemon", false, "No console output, the replay is controlled via /replay on the web interface.")
+	_ = flags.Parse(args)
+
+	if flags.NArg() != 1 || speed <= 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	if err := setupCounters(); err != nil {
+		log.Fatalf("Invalid counter list %v", err)
+	}
+	if err := validateJobOptions(jobMode, jobSortBy); err != nil {
+		log.Fatalf("Invalid -jobmode or -jobsort: %v", err)
+	}
+	if err := setupJobIDs(); err != nil {
+		log.Fatalf("Invalid job ID options: %v", err)
+	}
+
+	var from, to time.Time
+	var err error
+	if strFrom != "" {
+		if from, err = parseReplayTime(strFrom); err != nil {
+			log.Fatalf("Invalid -from time: %v", err)
+		}
+	}
+	if strTo != "" {
+		if to, err = parseReplayTime(strTo); err != nil {
+			log.Fatalf("Invalid -to time: %v", err)
+		}
+	}
+
+	samples, err := loadSamples(flags.Arg(0), from, to)
+	if err != nil {
+		log.Fatalf("Can't load recording: %v", err)
+	}
+	if len(samples) == 0 {
+		log.Fatalln("No samples found in the selected time range.")
+	}
+	if err := setupLogging(); err != nil {
+		log.Fatalf("Invalid logging options: %v", err)
+	}
+
+	var r = &replayer{samples: samples, speed: speed, wake: make(chan struct{}, 1), quit: make(chan struct{})}
+
+	http.HandleFunc("/replay", r.httpReplay)
+	if noHTTP != true {
+		startHTTPServer(listenAddresses(httpListen, httpPort))
+	}
+
+	var console = !daemon
+	if console {
+		restore, err := setCbreakMode()
+		if err != nil {
+			logWarn("keyboard controls not available", "error", err)
+		} else {
+			defer restore()
+			go r.readKeys()
+		}
+	}
+	r.run(console)
+}
@@ -0,0 +1,194 @@
+/*
+MIT License
+
+Copyright (c) 2020 storagebit.ch
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// selfMetrics are lure's own metrics, per component: the collectors, e.g. collector.ost, the sinks, e.g.
+// sink.influxdb, and the web interface. They are served on /api/v1/metrics and sent to the sinks with the stats.
+type selfMetrics struct {
+	sync.Mutex
+	metrics map[string]map[string]uint64
+}
+
+var lureMetrics = selfMetrics{metrics: make(map[string]map[string]uint64)}
+
+// selfMetricCounters are the counters of each kind of component. All of them count up from the start of lure
+// except the gauges, which hold the value of the last sample.
+var selfMetricCounters = map[string][]string{
+	"collector": {"sample_duration_us", "files_read", "read_errors", "read_timeouts", "parse_errors", "errors"},
+	"file":      {"read_latency_us"},
+	"sink":      {"errors"},
+	"http":      {"requests", "requests_4xx", "requests_5xx"},
+}
+
+var selfMetricGauges = map[string]bool{"sample_duration_us": true, "read_latency_us": true}
+
+// component returns the counters of a component, a new component starts with all its counters at zero. Must
+// be called with the lock held.
+func (m *selfMetrics) component(name string) map[string]uint64 {
+	var counters, found = m.metrics[name]
+	if !found {
+		counters = make(map[string]uint64)
+		var kind, _, _ = strings.Cut(name, ".")
+		for _, counter := range selfMetricCounters[kind] {
+			counters[counter] = 0
+		}
+		m.metrics[name] = counters
+	}
+	return counters
+}
+
+// register makes components show up before anything happened, e.g. a sink without errors.
+func (m *selfMetrics) register(names ...string) {
+	m.Lock()
+	defer m.Unlock()
+	for _, name := range names {
+		m.component(name)
+	}
+}
+
+func (m *selfMetrics) add(name string, counter string, delta uint64) {
+	m.Lock()
+	defer m.Unlock()
+	m.component(name)[counter] += delta
+}
+
+func (m *selfMetrics) set(name string, counter string, value uint64) {
+	m.Lock()
+	defer m.Unlock()
+	m.component(name)[counter] = value
+}
+
+// forget removes the components starting with prefix which aren't kept, e.g. the files of a vanished device.
+func (m *selfMetrics) forget(prefix string, keep map[string]bool) {
+	m.Lock()
+	defer m.Unlock()
+	for name := range m.metrics {
+		if strings.HasPrefix(name, prefix) && !keep[name] {
+			delete(m.metrics, name)
+		}
+	}
+}
+
+// snapshot copies the metrics, the copy is safe to use without the lock.
+func (m *selfMetrics) snapshot() map[string]map[string]uint64 {
+	m.Lock()
+	defer m.Unlock()
+	var metrics = make(map[string]map[string]uint64)
+	for name, counters := range m.metrics {
+		metrics[name] = make(map[string]uint64)
+		for counter, value := range counters {
+			metrics[name][counter] = value
+		}
+	}
+	return metrics
+}
+
+// selfMetricNames returns all counter names in use, sorted.
+func selfMetricNames(metrics map[string]map[string]uint64) []string {
+	var names = make(map[string]uint64)
+	for _, counters := range metrics {
+		for counter := range counters {
+			names[counter] = 0
+		}
+	}
+	return sortedCounters(names)
+}
+
+// sinkFailed counts and logs an error of a sink.
+func sinkFailed(sink string, err error) {
+	lureMetrics.add("sink."+sink, "errors", 1)
+	logError("sink failed", "sink", sink, "error", err)
+}
+
+// countRequests counts the requests of the web interface by status class.
+func countRequests(next http.Handler) http.Handler {
+	lureMetrics.register("http")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var start = time.Now()
+		var recorder = &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r)
+
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+		lureMetrics.add("http", "requests", 1)
+		switch {
+		case recorder.status >= 500:
+			lureMetrics.add("http", "requests_5xx", 1)
+		case recorder.status >= 400:
+			lureMetrics.add("http", "requests_4xx", 1)
+		}
+		logDebug("http request", "method", r.Method, "path", r.URL.Path, "status", recorder.status,
+			"remote", r.RemoteAddr, "duration", time.Since(start))
+	})
+}
+
+// statusRecorder remembers the status of a response. It passes flushing on for /stream and hijacking for the
+// WebSocket upgrade.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	if s.status == 0 {
+		s.status = status
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	return s.ResponseWriter.Write(b)
+}
+
+func (s *statusRecorder) Flush() {
+	if flusher, ok := s.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (s *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := s.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("the connection can't be taken over")
+	}
+	if s.status == 0 {
+		s.status = http.StatusSwitchingProtocols
+	}
+	return hijacker.Hijack()
+}
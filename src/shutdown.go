@@ -0,0 +1,129 @@
+/*
+MIT License
+
+Copyright (c) 2020 storagebit.ch
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// SIGINT, SIGTERM, q in the console and -count all end lure the same way: the sample loop stops, the sinks send
+// what they still have and the web interface finishes the running requests, all within -shutdowntimeout.
+var shutdownTimeout time.Duration
+var shutdownRequests = make(chan struct{}, 1)
+var shutdownHooks []func()
+var shutdownSignals sync.Once
+
+// httpServers are the servers of all web interface listeners.
+var httpServers []*http.Server
+
+// addShutdownFlags registers the shutdown flags on a flag set.
+func addShutdownFlags(flags *flag.FlagSet) {
+	flags.DurationVar(&shutdownTimeout, "shutdowntimeout", 10*time.Second,
+		"Time the sinks and the web interface get to finish on shutdown")
+}
+
+// startShutdownHandler requests a shutdown on SIGINT and SIGTERM.
+func startShutdownHandler() {
+	shutdownSignals.Do(func() {
+		var signals = make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		go func() {
+			for range signals {
+				requestShutdown()
+			}
+		}()
+	})
+}
+
+// requestShutdown asks the sample loop to shut down, it notices while waiting for the next sample.
+func requestShutdown() {
+	select {
+	case shutdownRequests <- struct{}{}:
+	default:
+	}
+}
+
+// onShutdown registers a function called first thing on shutdown, e.g. to restore the terminal.
+func onShutdown(hook func()) {
+	shutdownHooks = append(shutdownHooks, hook)
+}
+
+// waitForNextSample sleeps for the given time and reports whether lure is asked to shut down meanwhile.
+func waitForNextSample(d time.Duration) bool {
+	var timer = time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return false
+	case <-shutdownRequests:
+		return true
+	}
+}
+
+// shutdown ends lure. It is called by the sample loop, so no sample is fed to the sinks at the same time.
+func shutdown() {
+	for _, hook := range shutdownHooks {
+		hook()
+	}
+	sdNotify("STOPPING=1")
+	logInfo("shutting down")
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	// Stream clients never go idle by themselves, ending the streams lets the servers shut down.
+	streams.closeAll()
+	for _, server := range httpServers {
+		wg.Add(1)
+		go func(server *http.Server) {
+			defer wg.Done()
+			if err := server.Shutdown(ctx); err != nil {
+				logError("shutting down the web interface failed", "error", err)
+			}
+		}(server)
+	}
+	if feedToOTLP {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := otlpDrain(ctx); err != nil {
+				sinkFailed("otlp", fmt.Errorf("sending the pending data points: %v", err))
+			}
+		}()
+	}
+	checkContinue(closeRecordFile())
+	checkContinue(batchOut.Flush())
+	wg.Wait()
+	os.Exit(0)
+}
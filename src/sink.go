@@ -0,0 +1,182 @@
+/*
+MIT License
+
+Copyright (c) 2020 storagebit.ch
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Sink is an output the stats are sent to after every sample. A new output is a new Sink passed to
+// registerSink, the main loop doesn't change.
+type Sink interface {
+	Name() string
+	Enabled() bool
+	// Write sends the rates of a sample, the totals hold the raw counters for outputs which want them. The
+	// sample carries lure's own metrics in Self.
+	Write(sample statsSample, totals statsSample) error
+}
+
+var sinks = []Sink{recordSink{}, influxSink{}, statsdSink{}, otlpSink{}}
+
+func registerSink(s Sink) {
+	sinks = append(sinks, s)
+}
+
+// currentTotals collects the raw counters of the latest sample.
+func currentTotals() statsSample {
+	return statsSample{
+		Time:     sampleTime,
+		Host:     hostname,
+		Interval: interval,
+		MDT:      mapMDTTotalStats,
+		OST:      mapOSTTotalStats,
+		Client:   mapLliteTotalStats,
+		MDTJob:   mapMDTJobTotalStats,
+		OSTJob:   mapOSTJobTotalStats,
+	}
+}
+
+// sampleSection returns the stats of one type of a sample, job stats in the second map.
+func sampleSection(sample statsSample, statsType string) (map[string]map[string]uint64,
+	map[string]map[string]map[string]uint64) {
+	switch statsType {
+	case "mdt":
+		return sample.MDT, nil
+	case "ost":
+		return sample.OST, nil
+	case "client":
+		return sample.Client, nil
+	case "mdtjob":
+		return nil, sample.MDTJob
+	case "ostjob":
+		return nil, sample.OSTJob
+	}
+	return nil, nil
+}
+
+// feedSinks pushes the latest calculated stats to all enabled outputs. It is called once per sample, both in
+// console and in daemon mode. A failing sink is counted and logged, the others still get the sample.
+func feedSinks() {
+	streams.publish(currentSample())
+	history.add(currentSample())
+
+	var sample = currentSample()
+	var totals = currentTotals()
+	for _, sink := range sinks {
+		if sink.Enabled() {
+			lureMetrics.register("sink." + sink.Name())
+		}
+	}
+	sample.Self = lureMetrics.snapshot()
+	for _, sink := range sinks {
+		if sink.Enabled() {
+			writeSink(sink, sample, totals)
+		}
+	}
+}
+
+func writeSink(sink Sink, sample statsSample, totals statsSample) {
+	defer func() {
+		if r := recover(); r != nil {
+			sinkFailed(sink.Name(), fmt.Errorf("sink panicked: %v", r))
+		}
+	}()
+	if err := sink.Write(sample, totals); err != nil {
+		sinkFailed(sink.Name(), err)
+	}
+}
+
+// recordSink writes the samples to -record.
+type recordSink struct{}
+
+func (recordSink) Name() string  { return "record" }
+func (recordSink) Enabled() bool { return recordDir != "" }
+
+func (recordSink) Write(sample statsSample, _ statsSample) error {
+	return recordSample(sample)
+}
+
+// influxSink writes to InfluxDB. The writes are asynchronous, their errors are reported by influxWriter.
+type influxSink struct{}
+
+func (influxSink) Name() string  { return "influxdb" }
+func (influxSink) Enabled() bool { return feedToInflux }
+
+func (influxSink) Write(sample statsSample, _ statsSample) error {
+	for _, statsType := range statsTypes {
+		var stats, jobs = sampleSection(sample, statsType)
+		if len(stats) != 0 {
+			feedStatsToInflux(stats, sortStatsMapIntoSlice(stats), *counterList(statsType))
+		}
+		if len(jobs) != 0 {
+			feedJobStatsToInflux(jobs, sortJobsMapIntoSlice(jobs), *counterList(statsType))
+		}
+	}
+	feedSelfMetricsToInflux(sample.Self, sortStatsMapIntoSlice(sample.Self), selfMetricNames(sample.Self))
+	return nil
+}
+
+// statsdSink sends to a StatsD or DogStatsD agent.
+type statsdSink struct{}
+
+func (statsdSink) Name() string  { return "statsd" }
+func (statsdSink) Enabled() bool { return feedToStatsd }
+
+func (statsdSink) Write(sample statsSample, _ statsSample) error {
+	var lines []string
+	for _, statsType := range statsTypes {
+		var stats, jobs = sampleSection(sample, statsType)
+		lines = append(lines, statsdStatsLines(stats, sortStatsMapIntoSlice(stats), *counterList(statsType),
+			statsType)...)
+		lines = append(lines, statsdJobStatsLines(jobs, sortJobsMapIntoSlice(jobs), *counterList(statsType),
+			statsType)...)
+	}
+	lines = append(lines, statsdSelfMetricsLines(sample.Self, sortStatsMapIntoSlice(sample.Self),
+		selfMetricNames(sample.Self))...)
+	return statsdSend(lines)
+}
+
+// otlpSink queues the data points for the OTLP exporter, which reports its errors itself.
+type otlpSink struct{}
+
+func (otlpSink) Name() string  { return "otlp" }
+func (otlpSink) Enabled() bool { return feedToOTLP }
+
+func (otlpSink) Write(sample statsSample, totals statsSample) error {
+	for _, statsType := range statsTypes {
+		var stats, jobs = sampleSection(sample, statsType)
+		var statsTotals, jobTotals = sampleSection(totals, statsType)
+		if len(stats) != 0 {
+			feedStatsToOTLP(statsTotals, stats, sortStatsMapIntoSlice(stats), *counterList(statsType), statsType)
+		}
+		if len(jobs) != 0 {
+			feedJobStatsToOTLP(jobTotals, jobs, sortJobsMapIntoSlice(jobs), *counterList(statsType), statsType)
+		}
+	}
+	feedSelfMetricsToOTLP(sample.Self, sortStatsMapIntoSlice(sample.Self), selfMetricNames(sample.Self))
+	otlpForgetSeries(time.Now())
+	return nil
+}
@@ -0,0 +1,218 @@
+/*
+MIT License
+
+Copyright (c) 2020 storagebit.ch
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Maximum payload per datagram. 1432 bytes keeps a UDP packet below the common 1500 byte MTU, the unix
+// datagram socket of the Datadog agent accepts up to 8 KiB.
+const (
+	statsdUDPPayloadSize  = 1432
+	statsdUnixPayloadSize = 8192
+)
+
+var (
+	feedToStatsd     bool
+	statsdAddress    string
+	statsdPrefix     string
+	statsdSampleRate float64
+	statsdType       string
+	statsdTags       bool
+)
+
+// statsdDial opens the connection to the StatsD agent. Addresses starting with unix:// are treated as a unix
+// datagram socket, everything else as a UDP host:port.
+func statsdDial() (net.Conn, int, error) {
+	if strings.HasPrefix(statsdAddress, "unix://") {
+		conn, err := net.Dial("unixgram", strings.TrimPrefix(statsdAddress, "unix://"))
+		return conn, statsdUnixPayloadSize, err
+	}
+	conn, err := net.Dial("udp", statsdAddress)
+	return conn, statsdUDPPayloadSize, err
+}
+
+// statsdSanitize replaces all characters StatsD uses as separators in metric names and tags.
+func statsdSanitize(s string, keepDots bool) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_', r == '-':
+			return r
+		case r == '.' && keepDots:
+			return r
+		}
+		return '_'
+	}, s)
+}
+
+// statsdLine formats a single metric. With DogStatsD tags enabled the server, device and job end up as tags,
+// otherwise they are encoded into the metric name.
+func statsdLine(statsType string, device string, job string, counter string, value uint64) string {
+	var name, tags = statsdName(statsType, device, job, counter)
+
+	var line string
+	if statsdType == "counter" {
+		// The stats are per second rates, a counter gets the increment over the seconds the rates cover.
+		var seconds, _ = collectedSecondsOf(statsType)
+		line = name + ":" + strconv.FormatUint(value*seconds, 10) + "|c"
+		if statsdSampleRate < 1 {
+			line += "|@" + strconv.FormatFloat(statsdSampleRate, 'f', -1, 64)
+		}
+	} else {
+		line = name + ":" + strconv.FormatUint(value, 10) + "|g"
+	}
+	return line + tags
+}
+
+// statsdName returns the metric name and the DogStatsD tags suffix of a metric.
+func statsdName(statsType string, device string, job string, counter string) (string, string) {
+	var name []string
+	var tags []string
+
+	name = append(name, statsdPrefix)
+	if statsdTags {
+		name = append(name, statsType, counter)
+		tags = append(tags, "server:"+statsdSanitize(hostname, true), "device:"+statsdSanitize(device, true))
+		if job != "" {
+			tags = append(tags, "job:"+statsdSanitize(job, true))
+		}
+	} else {
+		name = append(name, statsdSanitize(hostname, false), statsType, statsdSanitize(device, false))
+		if job != "" {
+			name = append(name, statsdSanitize(job, false))
+		}
+		name = append(name, counter)
+	}
+
+	if len(tags) > 0 {
+		return strings.Join(name, "."), "|#" + strings.Join(tags, ",")
+	}
+	return strings.Join(name, "."), ""
+}
+
+// statsdSend packs the metric lines into as few datagrams as possible and sends them off. The socket is opened
+// per sample so a restarted agent is picked up again with the next sample.
+func statsdSend(lines []string) error {
+	conn, payloadSize, err := statsdDial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var packet strings.Builder
+	for _, line := range lines {
+		if packet.Len() > 0 && packet.Len()+len(line)+1 > payloadSize {
+			if _, err := conn.Write([]byte(packet.String())); err != nil {
+				return err
+			}
+			packet.Reset()
+		}
+		if packet.Len() > 0 {
+			packet.WriteString("\n")
+		}
+		packet.WriteString(line)
+	}
+	if packet.Len() > 0 {
+		if _, err := conn.Write([]byte(packet.String())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// statsdSampled decides if a metric is sent, honouring the configured sample rate. Only counters carry the
+// rate the agent scales them up with, gauges are always sent as a dropped gauge would simply be lost.
+func statsdSampled() bool {
+	return statsdType != "counter" || statsdSampleRate >= 1 || rand.Float64() < statsdSampleRate
+}
+
+// statsdCounted tells if the stats of a collector are sent. The increments of a collector which runs less
+// often than the interval were already sent with its last run, gauges are always sent.
+func statsdCounted(statsType string) bool {
+	if statsdType != "counter" {
+		return true
+	}
+	var _, ran = collectedSecondsOf(statsType)
+	return ran
+}
+
+func statsdStatsLines(mapStats map[string]map[string]uint64, slcDevices []string, slcCounters []string, statsType string) []string {
+
+	var lines []string
+	if !statsdCounted(statsType) {
+		return lines
+	}
+
+	for _, device := range slcDevices {
+		for _, counter := range slcCounters {
+			if v, found := mapStats[device][counter]; found && statsdSampled() {
+				lines = append(lines, statsdLine(statsType, device, "", counter, v))
+			}
+		}
+	}
+	return lines
+}
+
+func statsdJobStatsLines(mapJobStats map[string]map[string]map[string]uint64, slcJobs []string, slcCounters []string, statsType string) []string {
+
+	var lines []string
+	if !statsdCounted(statsType) {
+		return lines
+	}
+
+	for _, jobHash := range slcJobs {
+		var device = strings.Split(jobHash, "@@")[0]
+		var job = strings.Split(jobHash, "@@")[1]
+
+		for _, counter := range slcCounters {
+			if v, found := mapJobStats[device][job][counter]; found && statsdSampled() {
+				lines = append(lines, statsdLine(statsType, device, job, counter, v))
+			}
+		}
+	}
+	return lines
+}
+
+// statsdSelfMetricsLines returns lure's own metrics as gauges, e.g. lure.<server>.self.collector_ost.files_read,
+// independent of -statsdtype and the sample rate as the counters already count up.
+func statsdSelfMetricsLines(metrics map[string]map[string]uint64, slcComponents []string,
+	slcCounters []string) []string {
+
+	var lines []string
+
+	for _, component := range slcComponents {
+		for _, counter := range slcCounters {
+			if v, found := metrics[component][counter]; found {
+				var name, tags = statsdName("self", component, "", counter)
+				lines = append(lines, name+":"+strconv.FormatUint(v, 10)+"|g"+tags)
+			}
+		}
+	}
+	return lines
+}
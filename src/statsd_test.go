@@ -0,0 +1,160 @@
+/*
+MIT License
+
+Copyright (c) 2020 storagebit.ch
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// statsdListen starts a UDP listener standing in for the StatsD agent and points lure at it.
+func statsdListen(t *testing.T) *net.UDPConn {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	statsdAddress = conn.LocalAddr().String()
+	return conn
+}
+
+// statsdReceive returns the lines of all datagrams received until nothing arrives for a moment, sorted.
+func statsdReceive(t *testing.T, conn *net.UDPConn) []string {
+	var lines []string
+	var buf = make([]byte, 65536)
+	for {
+		_ = conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		n, err := conn.Read(buf)
+		if err != nil {
+			break
+		}
+		lines = append(lines, strings.Split(string(buf[:n]), "\n")...)
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+func statsdTestSample() statsSample {
+	return statsSample{
+		OST:    map[string]map[string]uint64{"testfs-OST0000": {"write_bytes": 100, "statfs": 2}},
+		OSTJob: map[string]map[string]map[string]uint64{"testfs-OST0000": {"dd.0": {"write_bytes": 40}}},
+		Self:   map[string]map[string]uint64{"sink.statsd": {"errors": 0}},
+	}
+}
+
+func statsdTestSetup(t *testing.T, metricType string, tags bool, sampleRate float64) {
+	var saved = []interface{}{hostname, interval, statsdPrefix, statsdType, statsdTags, statsdSampleRate,
+		statsdAddress, ostCounters, ostJobStatsCounters, collectedSeconds}
+	t.Cleanup(func() {
+		hostname, interval, statsdPrefix = saved[0].(string), saved[1].(int), saved[2].(string)
+		statsdType, statsdTags, statsdSampleRate = saved[3].(string), saved[4].(bool), saved[5].(float64)
+		statsdAddress, ostCounters, ostJobStatsCounters = saved[6].(string), saved[7].([]string), saved[8].([]string)
+		collectedSeconds = saved[9].(map[string]uint64)
+	})
+	hostname, interval, statsdPrefix = "oss01", 5, "lure"
+	statsdType, statsdTags, statsdSampleRate = metricType, tags, sampleRate
+	ostCounters, ostJobStatsCounters = []string{"write_bytes", "statfs"}, []string{"write_bytes"}
+}
+
+func TestStatsdGauges(t *testing.T) {
+	statsdTestSetup(t, "gauge", false, 1)
+	var conn = statsdListen(t)
+
+	if err := (statsdSink{}).Write(statsdTestSample(), statsSample{}); err != nil {
+		t.Fatal(err)
+	}
+	var got = statsdReceive(t, conn)
+	var want = []string{
+		"lure.oss01.ost.testfs-OST0000.statfs:2|g",
+		"lure.oss01.ost.testfs-OST0000.write_bytes:100|g",
+		"lure.oss01.ostjob.testfs-OST0000.dd_0.write_bytes:40|g",
+		"lure.oss01.self.sink_statsd.errors:0|g",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got lines\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestStatsdDogStatsdCounters(t *testing.T) {
+	statsdTestSetup(t, "counter", true, 1)
+	var conn = statsdListen(t)
+
+	if err := (statsdSink{}).Write(statsdTestSample(), statsSample{}); err != nil {
+		t.Fatal(err)
+	}
+	var got = statsdReceive(t, conn)
+	// Counters get the increment over the interval, the self metrics stay gauges.
+	var want = []string{
+		"lure.ost.statfs:10|c|#server:oss01,device:testfs-OST0000",
+		"lure.ost.write_bytes:500|c|#server:oss01,device:testfs-OST0000",
+		"lure.ostjob.write_bytes:200|c|#server:oss01,device:testfs-OST0000,job:dd.0",
+		"lure.self.errors:0|g|#server:oss01,device:sink.statsd",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got lines\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestStatsdCollectorIntervals(t *testing.T) {
+	statsdTestSetup(t, "counter", true, 1)
+	var conn = statsdListen(t)
+	// The OST stats cover 30 seconds, the job stats are collected less often and weren't in this sample.
+	collectedSeconds = map[string]uint64{"ost": 30}
+
+	if err := (statsdSink{}).Write(statsdTestSample(), statsSample{}); err != nil {
+		t.Fatal(err)
+	}
+	var got = statsdReceive(t, conn)
+	var want = []string{
+		"lure.ost.statfs:60|c|#server:oss01,device:testfs-OST0000",
+		"lure.ost.write_bytes:3000|c|#server:oss01,device:testfs-OST0000",
+		"lure.self.errors:0|g|#server:oss01,device:sink.statsd",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got lines\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestStatsdSampleRate(t *testing.T) {
+	statsdTestSetup(t, "gauge", false, 0.000001)
+	var conn = statsdListen(t)
+
+	if err := (statsdSink{}).Write(statsdTestSample(), statsSample{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := statsdReceive(t, conn); len(got) != 4 {
+		t.Errorf("gauges have to be sent regardless of the sample rate, got %q", got)
+	}
+
+	statsdType = "counter"
+	statsdSampleRate = 0.5
+	var line = statsdLine("ost", "testfs-OST0000", "", "write_bytes", 100)
+	if !strings.HasSuffix(line, "|c|@0.5") {
+		t.Errorf("sampled counter %q has no sample rate", line)
+	}
+}
@@ -0,0 +1,347 @@
+/*
+MIT License
+
+Copyright (c) 2020 storagebit.ch
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// Drop policies for stream subscribers which don't keep up with the samples.
+const (
+	dropOldest = "drop-oldest"
+	dropNewest = "drop-newest"
+	disconnect = "disconnect"
+)
+
+var (
+	streamBuffer  int
+	streamPolicy  string
+	streamOrigins string
+
+	streams streamHub
+)
+
+// streamHub keeps track of the /stream subscribers.
+type streamHub struct {
+	sync.Mutex
+	subscribers map[*streamSubscriber]bool
+}
+
+// streamSubscriber is one /stream client. Messages are encoded by the sampling loop, the client connection
+// only writes what arrives on the buffered channel.
+type streamSubscriber struct {
+	messages chan streamEvent
+	closed   chan struct{}
+	reason   string // why closed was closed
+	policy   string
+	stats    map[string]bool
+	dropped  uint64
+	statsFilter
+}
+
+// streamEvent is one encoded message, queued for a subscriber.
+type streamEvent struct {
+	stats string
+	data  []byte
+}
+
+// streamMessage is the payload of one stream event, the stats of one type for one sample.
+type streamMessage struct {
+	Time     time.Time   `json:"time"`
+	Host     string      `json:"host"`
+	Interval int         `json:"interval"`
+	Stats    string      `json:"stats"`
+	Dropped  uint64      `json:"dropped"`
+	Data     interface{} `json:"data"`
+}
+
+func addStreamFlags(flags *flag.FlagSet) {
+	flags.IntVar(&streamBuffer, "streambuffer", 16, "Number of samples buffered for each /stream subscriber.")
+	flags.StringVar(&streamPolicy, "streampolicy", dropOldest,
+		"What to do with /stream subscribers which fall behind: drop-oldest, drop-newest or disconnect.")
+	flags.StringVar(&streamOrigins, "streamorigins", "",
+		"Comma separated origins, e.g. https://dashboard.example.com, allowed to open a /stream WebSocket from another site.")
+}
+
+// streamOriginAllowed checks the Origin of a WebSocket upgrade, so other sites can't open the stream with the
+// credentials of a logged in browser. Clients which aren't browsers send no Origin and are allowed.
+func streamOriginAllowed(r *http.Request) bool {
+	var origin = r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if parsed, err := url.Parse(origin); err == nil && strings.EqualFold(parsed.Host, r.Host) {
+		return true
+	}
+	for _, allowed := range strings.Split(streamOrigins, ",") {
+		if allowed = strings.TrimSpace(allowed); allowed != "" && strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// newStreamSubscriber parses the filters of a /stream request.
+func newStreamSubscriber(query url.Values) (*streamSubscriber, error) {
+	filter, err := parseStatsFilter(query)
+	if err != nil {
+		return nil, err
+	}
+	var subscriber = &streamSubscriber{
+		closed:      make(chan struct{}),
+		policy:      streamPolicy,
+		statsFilter: filter,
+	}
+	if policy := query.Get("policy"); policy != "" {
+		subscriber.policy = policy
+	}
+	switch subscriber.policy {
+	case dropOldest, dropNewest, disconnect:
+	default:
+		return nil, fmt.Errorf("unknown policy %q, use drop-oldest, drop-newest or disconnect", subscriber.policy)
+	}
+
+	var buffer = streamBuffer
+	if value := query.Get("buffer"); value != "" {
+		if buffer, err = strconv.Atoi(value); err != nil || buffer < 1 {
+			return nil, fmt.Errorf("invalid buffer %q", value)
+		}
+	}
+	subscriber.messages = make(chan streamEvent, buffer)
+
+	if stats := query.Get("stats"); stats != "" {
+		subscriber.stats = make(map[string]bool)
+		for _, statsType := range strings.Split(stats, ",") {
+			if countersOf(statsType) == nil {
+				return nil, fmt.Errorf("unknown stats type %q", statsType)
+			}
+			subscriber.stats[statsType] = true
+		}
+	}
+	return subscriber, nil
+}
+
+// send queues a message and applies the drop policy if the subscriber's buffer is full. It returns false if the
+// subscriber has to be disconnected.
+func (s *streamSubscriber) send(message streamEvent) bool {
+	select {
+	case s.messages <- message:
+		return true
+	default:
+	}
+	s.dropped++
+	switch s.policy {
+	case dropNewest:
+		return true
+	case dropOldest:
+		select {
+		case <-s.messages:
+		default:
+		}
+		select {
+		case s.messages <- message:
+		default:
+		}
+		return true
+	}
+	return false
+}
+
+// publish hands a sample to all subscribers, one message for each stats type the subscriber is interested in.
+// It never blocks the sampling loop, slow subscribers are dealt with according to their drop policy.
+func (h *streamHub) publish(sample statsSample) {
+	h.Lock()
+	defer h.Unlock()
+
+	for subscriber := range h.subscribers {
+		var sections = []struct {
+			stats string
+			data  interface{}
+			empty bool
+		}{
+			{"mdt", subscriber.filterStats(sample.MDT), len(sample.MDT) == 0},
+			{"ost", subscriber.filterStats(sample.OST), len(sample.OST) == 0},
+			{"client", subscriber.filterStats(sample.Client), len(sample.Client) == 0},
+			{"mdtjob", subscriber.filterJobStats(sample.MDTJob), len(sample.MDTJob) == 0},
+			{"ostjob", subscriber.filterJobStats(sample.OSTJob), len(sample.OSTJob) == 0},
+		}
+		for _, section := range sections {
+			if section.empty || (subscriber.stats != nil && !subscriber.stats[section.stats]) {
+				continue
+			}
+			message, err := json.Marshal(streamMessage{
+				Time:     sample.Time,
+				Host:     sample.Host,
+				Interval: sample.Interval,
+				Stats:    section.stats,
+				Dropped:  subscriber.dropped,
+				Data:     section.data,
+			})
+			if err != nil {
+				logError("encoding stream message failed", "error", err)
+				continue
+			}
+			if !subscriber.send(streamEvent{section.stats, message}) {
+				delete(h.subscribers, subscriber)
+				subscriber.reason = "too slow, disconnected"
+				close(subscriber.closed)
+				break
+			}
+		}
+	}
+}
+
+func (h *streamHub) subscribe(subscriber *streamSubscriber) {
+	h.Lock()
+	defer h.Unlock()
+	if h.subscribers == nil {
+		h.subscribers = make(map[*streamSubscriber]bool)
+	}
+	h.subscribers[subscriber] = true
+}
+
+func (h *streamHub) unsubscribe(subscriber *streamSubscriber) {
+	h.Lock()
+	defer h.Unlock()
+	if h.subscribers[subscriber] {
+		delete(h.subscribers, subscriber)
+		close(subscriber.closed)
+	}
+}
+
+// closeAll ends all subscriptions, the handlers return and the clients see the end of the stream.
+func (h *streamHub) closeAll() {
+	h.Lock()
+	defer h.Unlock()
+	for subscriber := range h.subscribers {
+		delete(h.subscribers, subscriber)
+		subscriber.reason = "lure is shutting down"
+		close(subscriber.closed)
+	}
+}
+
+// httpStream serves /stream as Server-Sent Events, or as WebSocket if the client asks for an upgrade. The
+// filters are query parameters, e.g. /stream?stats=ostjob&device=*OST0001&job=1234*
+func httpStream(w http.ResponseWriter, r *http.Request) {
+	subscriber, err := newStreamSubscriber(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		var server = websocket.Server{
+			Handshake: func(_ *websocket.Config, r *http.Request) error {
+				if !streamOriginAllowed(r) {
+					return fmt.Errorf("origin %s not allowed, see -streamorigins", r.Header.Get("Origin"))
+				}
+				return nil
+			},
+			Handler: func(conn *websocket.Conn) { streamWebSocket(conn, subscriber) },
+		}
+		server.ServeHTTP(w, r)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	streams.subscribe(subscriber)
+	defer streams.unsubscribe(subscriber)
+
+	// Comment lines keep proxies from closing an idle connection, e.g. with a long interval or a paused replay.
+	var keepalive = time.NewTicker(15 * time.Second)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+		case message := <-subscriber.messages:
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", message.stats, message.data); err != nil {
+				return
+			}
+		case <-subscriber.closed:
+			fmt.Fprintf(w, "event: error\ndata: %s\n\n", subscriber.reason)
+			flusher.Flush()
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// streamWebSocket sends every message as one text frame. Anything the client sends is ignored, reading only
+// notices a closed connection.
+func streamWebSocket(conn *websocket.Conn, subscriber *streamSubscriber) {
+	defer conn.Close()
+
+	streams.subscribe(subscriber)
+	defer streams.unsubscribe(subscriber)
+
+	var gone = make(chan struct{})
+	go func() {
+		var discard = make([]byte, 512)
+		for {
+			if _, err := conn.Read(discard); err != nil {
+				close(gone)
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case <-gone:
+			return
+		case <-subscriber.closed:
+			return
+		case message := <-subscriber.messages:
+			if err := websocket.Message.Send(conn, string(message.data)); err != nil {
+				return
+			}
+		}
+	}
+}
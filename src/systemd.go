@@ -0,0 +1,172 @@
+/*
+MIT License
+
+Copyright (c) 2020 storagebit.ch
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sdNotify tells systemd about the state of lure if it runs as a Type=notify service, see sd_notify(3).
+// Without $NOTIFY_SOCKET it does nothing.
+func sdNotify(state string) {
+	var socket = os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return
+	}
+	if strings.HasPrefix(socket, "@") {
+		// Abstract namespace socket.
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		logError("notifying systemd failed", "error", err)
+		return
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		logError("notifying systemd failed", "error", err)
+	}
+}
+
+// sdWatchdog returns the watchdog timeout systemd expects a WATCHDOG=1 within, 0 if there is none.
+func sdWatchdog() time.Duration {
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// sdReady tells systemd that lure is up. The watchdog is kept happy with every sample, so a watchdog shorter than
+// the interval would kill lure over and over.
+func sdReady() {
+	if watchdog := sdWatchdog(); watchdog > 0 && watchdog <= time.Duration(interval)*time.Second {
+		logWarn("the systemd watchdog is not longer than the interval, use a longer WatchdogSec", "watchdog",
+			watchdog, "interval", time.Duration(interval)*time.Second)
+	}
+	sdNotify("READY=1\nSTATUS=" + sdStatus())
+}
+
+// sdSampled pets the watchdog and updates the status shown by systemctl status.
+func sdSampled() {
+	sdNotify("WATCHDOG=1\nSTATUS=" + sdStatus())
+}
+
+func sdStatus() string {
+	var status = fmt.Sprintf("%d MDTs, %d OSTs, %d client filesystems", len(mapMDTs), len(mapOSTs),
+		len(mapLliteFilesystems))
+	if !sampleTime.IsZero() {
+		status += ", last sample " + sampleTime.Format("15:04:05")
+	}
+	return status
+}
+
+// runInstallUnit implements lure install-unit, which writes a systemd unit running lure as a Type=notify service
+// with the watchdog enabled.
+func runInstallUnit(args []string) {
+	var output string
+	var config string
+	var watchdog time.Duration
+
+	var flags = flag.NewFlagSet("install-unit", flag.ExitOnError)
+	flags.StringVar(&output, "o", "/etc/systemd/system/lure.service", "Unit file to write, - for stdout")
+	flags.StringVar(&config, "config", defaultConfigFile, "Configuration file used by the service, if it exists")
+	flags.DurationVar(&watchdog, "watchdog", 30*time.Second,
+		"Restart lure if no sample is taken within this time, 0 to disable. Has to be longer than the interval")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s install-unit [options] [-- lure options]\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(args)
+
+	executable, err := os.Executable()
+	if err == nil {
+		executable, err = filepath.EvalSymlinks(executable)
+	}
+	if err != nil {
+		log.Fatalf("Can't find the lure executable: %v", err)
+	}
+
+	var command = []string{executable, "-daemon"}
+	if _, err := os.Stat(config); err == nil {
+		command = append(command, "-config", config)
+	} else if config != defaultConfigFile {
+		log.Fatalf("Can't use the configuration file: %v", err)
+	}
+	command = append(command, flags.Args()...)
+	for i, arg := range command {
+		command[i] = systemdQuote(arg)
+	}
+
+	var unit strings.Builder
+	unit.WriteString("[Unit]\n" +
+		"Description=lure Lustre real-time monitoring\n" +
+		"Documentation=https://github.com/storagebit/lure\n" +
+		"After=network-online.target\n" +
+		"Wants=network-online.target\n\n" +
+		"[Service]\n" +
+		"Type=notify\n" +
+		"NotifyAccess=main\n" +
+		"ExecStart=" + strings.Join(command, " ") + "\n" +
+		"ExecReload=/bin/kill -HUP $MAINPID\n" +
+		"Restart=on-failure\n" +
+		"RestartSec=5s\n")
+	if watchdog > 0 {
+		unit.WriteString("WatchdogSec=" + strconv.FormatInt(int64(watchdog/time.Second), 10) + "s\n")
+	}
+	unit.WriteString("\n[Install]\nWantedBy=multi-user.target\n")
+
+	if output == "-" {
+		fmt.Print(unit.String())
+		return
+	}
+	if err := ioutil.WriteFile(output, []byte(unit.String()), 0644); err != nil {
+		log.Fatalf("Can't write the unit file: %v", err)
+	}
+	fmt.Printf("Wrote %s, start lure with: systemctl daemon-reload && systemctl enable --now %s\n", output,
+		filepath.Base(output))
+}
+
+// systemdQuote quotes an ExecStart argument, see systemd.service(5) and systemd.unit(5) for % specifiers.
+func systemdQuote(arg string) string {
+	arg = strings.ReplaceAll(arg, "%", "%%")
+	arg = strings.ReplaceAll(arg, "$", "$$")
+	if arg != "" && !strings.ContainsAny(arg, " \t\"'\\;") {
+		return arg
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(arg) + `"`
+}
@@ -0,0 +1,556 @@
+/*
+MIT License
+
+Copyright (c) 2020 storagebit.ch
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/dustin/go-humanize"
+)
+
+// Interval changes requested in the console, the sampling loop picks them up before the next sample.
+var intervalRequests = make(chan int, 1)
+
+// requestInterval replaces a pending interval change.
+func requestInterval(seconds int) {
+	select {
+	case <-intervalRequests:
+	default:
+	}
+	intervalRequests <- seconds
+}
+
+// tuiRow is one line of a console table, a device or a job.
+type tuiRow struct {
+	name     string
+	counters map[string]uint64
+}
+
+// tuiSection is one of the tables which can be shown in the console.
+type tuiSection struct {
+	title    string
+	counters func() []string
+	rows     func(sample statsSample) []tuiRow
+}
+
+func deviceRows(stats map[string]map[string]uint64) []tuiRow {
+	var rows []tuiRow
+	for device, counters := range stats {
+		rows = append(rows, tuiRow{device, counters})
+	}
+	return rows
+}
+
+func jobRows(stats map[string]map[string]map[string]uint64) []tuiRow {
+	var rows []tuiRow
+	for device, jobs := range stats {
+		for job, counters := range jobs {
+			rows = append(rows, tuiRow{job + "@" + device, counters})
+		}
+	}
+	return rows
+}
+
+var tuiSections = []tuiSection{
+	{"MDT", func() []string { return mdtCounters },
+		func(sample statsSample) []tuiRow { return deviceRows(sample.MDT) }},
+	{"OST", func() []string { return ostCounters },
+		func(sample statsSample) []tuiRow { return deviceRows(sample.OST) }},
+	{"Client", func() []string { return lliteCounters },
+		func(sample statsSample) []tuiRow { return deviceRows(sample.Client) }},
+	{"MDT Jobs", func() []string { return mdtJobStatsCounters },
+		func(sample statsSample) []tuiRow { return jobRows(sample.MDTJob) }},
+	{"OST Jobs", func() []string { return ostJobStatsCounters },
+		func(sample statsSample) []tuiRow { return jobRows(sample.OSTJob) }},
+	{"Top Jobs", func() []string { return append([]string{"targets"}, jobCounters(jobMode)...) },
+		func(sample statsSample) []tuiRow {
+			var rows []tuiRow
+			for _, job := range jobTotals(sample, jobMode, statsFilter{}, "", "", 0) {
+				job.Counters["targets"] = uint64(job.Targets)
+				rows = append(rows, tuiRow{job.Job, job.Counters})
+			}
+			return rows
+		}},
+	{"Job Groups", func() []string { return append([]string{"targets"}, jobCounters(jobMode)...) },
+		func(sample statsSample) []tuiRow {
+			// Without -jobgroup the jobs are summed up by user.
+			var group = jobGroup
+			if group == "" {
+				group = "user"
+			}
+			var rows []tuiRow
+			for _, job := range jobTotals(sample, jobMode, statsFilter{}, group, "", 0) {
+				job.Counters["targets"] = uint64(job.Targets)
+				rows = append(rows, tuiRow{job.Job, job.Counters})
+			}
+			return rows
+		}},
+	{"Recent Jobs", func() []string { return []string{"targets", "bytes", "ops"} },
+		func(statsSample) []tuiRow {
+			var rows []tuiRow
+			for _, job := range recentJobList(jobMode, statsFilter{}, "", "", recentJobs) {
+				var name = job.Job
+				if job.State == "expired" {
+					name += " (expired)"
+				}
+				rows = append(rows, tuiRow{name, map[string]uint64{"targets": uint64(job.Targets),
+					"bytes": job.Bytes, "ops": job.Ops}})
+			}
+			return rows
+		}},
+}
+
+// tui is the interactive console. The sampling loop hands over every sample, key presses and terminal resizes
+// redraw the screen in between.
+type tui struct {
+	sync.Mutex
+	restore func()
+
+	sample   statsSample
+	latest   statsSample
+	paused   bool
+	pending  int
+	section  int
+	selected bool
+
+	sortColumn int // 0 sorts by name, 1 by the first counter and so on
+	reverse    bool
+	filter     string
+	regex      *regexp.Regexp
+	scroll     int
+	column     int
+
+	// Text typed after / (filter), ~ (regex filter) or i (interval).
+	prompt  rune
+	input   string
+	message string
+}
+
+// startTUI switches the terminal into the interactive console. It returns nil if stdin or stdout is not a
+// terminal, the console falls back to printing the tables then.
+func startTUI() *tui {
+	if !isTerminal(os.Stdin.Fd()) || !isTerminal(os.Stdout.Fd()) {
+		return nil
+	}
+	restore, err := setCbreakMode()
+	if err != nil {
+		return nil
+	}
+	var t = &tui{restore: restore}
+
+	// Alternate screen and hidden cursor, like top.
+	fmt.Print("\x1b[?1049h\x1b[?25l")
+
+	onShutdown(t.close)
+
+	var resized = make(chan os.Signal, 1)
+	notifyResize(resized)
+	go func() {
+		for range resized {
+			t.Lock()
+			t.render()
+			t.Unlock()
+		}
+	}()
+	go t.readKeys()
+	return t
+}
+
+// close restores the terminal, it is called on shutdown.
+func (t *tui) close() {
+	fmt.Print("\x1b[?25h\x1b[?1049l")
+	t.restore()
+}
+
+// update shows a new sample, unless the console is paused.
+func (t *tui) update(sample statsSample) {
+	t.Lock()
+	defer t.Unlock()
+
+	t.latest = sample
+	if t.pending == sample.Interval {
+		t.pending = 0
+	}
+	if t.paused {
+		t.render()
+		return
+	}
+	t.sample = sample
+	// Start with the first section that has stats until a section is picked.
+	if !t.selected && len(tuiSections[t.section].rows(sample)) == 0 {
+		for i, section := range tuiSections {
+			if len(section.rows(sample)) > 0 {
+				t.section = i
+				break
+			}
+		}
+	}
+	t.render()
+}
+
+// rows returns the filtered and sorted rows of the current section.
+func (t *tui) rows() []tuiRow {
+	var section = tuiSections[t.section]
+	var counters = section.counters()
+	var rows []tuiRow
+	for _, row := range section.rows(t.sample) {
+		if t.regex != nil && !t.regex.MatchString(row.name) {
+			continue
+		}
+		if t.filter != "" && !strings.Contains(strings.ToLower(row.name), strings.ToLower(t.filter)) {
+			continue
+		}
+		rows = append(rows, row)
+	}
+
+	sort.Slice(rows, func(i, j int) bool {
+		if t.sortColumn > 0 && t.sortColumn <= len(counters) {
+			var counter = counters[t.sortColumn-1]
+			if rows[i].counters[counter] != rows[j].counters[counter] {
+				// Counters sort highest first.
+				return (rows[i].counters[counter] > rows[j].counters[counter]) != t.reverse
+			}
+		}
+		return (rows[i].name < rows[j].name) != (t.reverse && t.sortColumn == 0)
+	})
+	return rows
+}
+
+// fit pads or cuts text to exactly width columns.
+func fit(text string, width int) string {
+	var runes = []rune(text)
+	if len(runes) > width {
+		return string(runes[:width])
+	}
+	return text + strings.Repeat(" ", width-len(runes))
+}
+
+func formatCounter(counter string, value uint64) string {
+	if strings.Contains(counter, "bytes") {
+		return humanize.Bytes(value)
+	}
+	return strconv.FormatUint(value, 10)
+}
+
+// render draws the whole screen, always exactly as high and wide as the terminal.
+func (t *tui) render() {
+	var width, height, err = terminalSize()
+	if err != nil || width < 20 || height < 6 {
+		width, height = 80, 24
+	}
+	var section = tuiSections[t.section]
+	var counters = section.counters()
+	// A reload or the counter discovery may leave fewer counters than the selected sort column.
+	if t.sortColumn > len(counters) {
+		t.sortColumn = 0
+	}
+	var rows = t.rows()
+	var lines []string
+
+	// Header
+	var header = "Lustre node: " + t.sample.Host + " | Time: " + t.sample.Time.Format("2006-01-02 15:04:05") +
+		" | Sample Interval: " + strconv.Itoa(t.sample.Interval) + "s"
+	if t.pending > 0 {
+		header += " (" + strconv.Itoa(t.pending) + "s from the next sample)"
+	}
+	lines = append(lines, "\x1b[1;30;42m"+fit(header, width)+"\x1b[0m")
+
+	// Sections, the current one highlighted
+	var tabs, tabsWidth = "", 0
+	for i, other := range tuiSections {
+		var tab = fmt.Sprintf(" %d %s ", i+1, other.title)
+		if tabsWidth+len(tab) > width {
+			break
+		}
+		tabsWidth += len(tab)
+		switch {
+		case i == t.section:
+			tabs += "\x1b[7m" + tab + "\x1b[0m"
+		case len(other.rows(t.sample)) == 0:
+			tabs += "\x1b[2m" + tab + "\x1b[0m"
+		default:
+			tabs += tab
+		}
+	}
+	lines = append(lines, tabs)
+
+	// Status
+	var visible = height - 5
+	if t.scroll > len(rows)-visible {
+		t.scroll = len(rows) - visible
+	}
+	if t.scroll < 0 {
+		t.scroll = 0
+	}
+	var sortName = "name"
+	if t.sortColumn > 0 && t.sortColumn <= len(counters) {
+		sortName = counters[t.sortColumn-1]
+	}
+	var status = "Sort: " + sortName
+	if t.reverse {
+		status += " (reversed)"
+	}
+	if t.regex != nil {
+		status += " | Filter: ~" + t.regex.String()
+	} else if t.filter != "" {
+		status += " | Filter: " + t.filter
+	}
+	var last = t.scroll + visible
+	if last > len(rows) {
+		last = len(rows)
+	}
+	status += fmt.Sprintf(" | Rows %d-%d of %d", t.scroll+1, last, len(rows))
+	if len(rows) == 0 {
+		status = strings.Replace(status, "Rows 1-0 of 0", "No rows", 1)
+	}
+	if t.paused {
+		status += " | PAUSED"
+	}
+	if t.message != "" {
+		status += " | " + t.message
+	}
+	lines = append(lines, "\x1b[1m"+fit(status, width)+"\x1b[0m")
+
+	// Table, the name column stays, the counter columns scroll horizontally
+	var nameWidth = 20
+	for _, row := range rows {
+		if len(row.name)+2 > nameWidth {
+			nameWidth = len(row.name) + 2
+		}
+	}
+	if nameWidth > width/2 {
+		nameWidth = width / 2
+	}
+	var columns = (width - nameWidth) / 13
+	if t.column > len(counters)-columns {
+		t.column = len(counters) - columns
+	}
+	if t.column < 0 {
+		t.column = 0
+	}
+	var shown = counters[t.column:]
+	if len(shown) > columns {
+		shown = shown[:columns]
+	}
+
+	var tableHeader = fit(" "+section.title, nameWidth)
+	if t.sortColumn == 0 {
+		tableHeader = "\x1b[7m" + tableHeader + "\x1b[0;1m"
+	}
+	for i, counter := range shown {
+		var cell = fmt.Sprintf("%13s", counter)
+		if t.sortColumn == t.column+i+1 {
+			cell = "\x1b[7m" + cell + "\x1b[0;1m"
+		}
+		tableHeader += cell
+	}
+	lines = append(lines, "\x1b[1m"+tableHeader+"\x1b[0m")
+	for _, row := range rows[t.scroll:last] {
+		var line = fit(" "+row.name, nameWidth)
+		for _, counter := range shown {
+			line += fmt.Sprintf("%13s", formatCounter(counter, row.counters[counter]))
+		}
+		lines = append(lines, line)
+	}
+	for len(lines) < height-1 {
+		lines = append(lines, "")
+	}
+
+	// Help or the prompt
+	var footer = fmt.Sprintf("q quit  tab/1-%d section  </> sort  r reverse  / filter  ~ regex  "+
+		"arrows/PgUp/PgDn scroll  space pause  +/- i interval", len(tuiSections))
+	switch t.prompt {
+	case '/':
+		footer = "Filter (substring, empty to clear): " + t.input + "_"
+	case '~':
+		footer = "Filter (regular expression, empty to clear): " + t.input + "_"
+	case 'i':
+		footer = "Sample interval in seconds: " + t.input + "_"
+	}
+	lines = append(lines, "\x1b[7m"+fit(footer, width)+"\x1b[0m")
+
+	var screen strings.Builder
+	screen.WriteString("\x1b[H")
+	for i, line := range lines {
+		screen.WriteString(line)
+		screen.WriteString("\x1b[K")
+		if i < len(lines)-1 {
+			screen.WriteString("\r\n")
+		}
+	}
+	_, _ = os.Stdout.WriteString(screen.String())
+}
+
+// readKeys handles the key presses. Escape sequences, e.g. of the arrow keys, arrive with a single read.
+func (t *tui) readKeys() {
+	var buffer = make([]byte, 64)
+	for {
+		n, err := os.Stdin.Read(buffer)
+		if err != nil {
+			return
+		}
+		t.Lock()
+		t.message = ""
+		if t.prompt != 0 {
+			t.promptKey(string(buffer[:n]))
+		} else {
+			t.key(string(buffer[:n]))
+		}
+		t.render()
+		t.Unlock()
+	}
+}
+
+// promptKey edits the text typed for the filter or the interval.
+func (t *tui) promptKey(key string) {
+	switch key {
+	case "\x1b":
+		t.prompt = 0
+	case "\r", "\n":
+		t.apply()
+		t.prompt = 0
+	case "\x7f", "\b":
+		if len(t.input) > 0 {
+			t.input = t.input[:len(t.input)-1]
+		}
+	default:
+		if !strings.HasPrefix(key, "\x1b") {
+			t.input += key
+		}
+	}
+}
+
+// apply takes over the text typed at the prompt.
+func (t *tui) apply() {
+	switch t.prompt {
+	case '/':
+		t.filter, t.regex = t.input, nil
+	case '~':
+		if t.input == "" {
+			t.filter, t.regex = "", nil
+			break
+		}
+		regex, err := regexp.Compile(t.input)
+		if err != nil {
+			t.message = "Invalid regular expression: " + err.Error()
+			return
+		}
+		t.filter, t.regex = "", regex
+	case 'i':
+		seconds, err := strconv.Atoi(t.input)
+		if err != nil || seconds < 1 {
+			t.message = "Invalid interval " + t.input
+			return
+		}
+		t.setInterval(seconds)
+	}
+	t.scroll = 0
+}
+
+func (t *tui) setInterval(seconds int) {
+	if seconds < 1 {
+		return
+	}
+	t.pending = seconds
+	if seconds == t.latest.Interval {
+		t.pending = 0
+	}
+	requestInterval(seconds)
+}
+
+// currentInterval is the interval of the next sample, including a pending change.
+func (t *tui) currentInterval() int {
+	if t.pending > 0 {
+		return t.pending
+	}
+	return t.latest.Interval
+}
+
+func (t *tui) key(key string) {
+	var _, height, err = terminalSize()
+	if err != nil {
+		height = 24
+	}
+	var page = height - 6
+	var counters = tuiSections[t.section].counters()
+	if t.sortColumn > len(counters) {
+		t.sortColumn = 0
+	}
+
+	switch key {
+	case "q", "Q":
+		requestShutdown()
+	case "\t":
+		t.section, t.selected, t.scroll, t.sortColumn = (t.section+1)%len(tuiSections), true, 0, 0
+	case "\x1b[Z":
+		t.section, t.selected, t.scroll, t.sortColumn = (t.section+len(tuiSections)-1)%len(tuiSections), true, 0, 0
+	case "<", ",":
+		t.sortColumn = (t.sortColumn + len(counters)) % (len(counters) + 1)
+	case ">", ".":
+		t.sortColumn = (t.sortColumn + 1) % (len(counters) + 1)
+	case "r":
+		t.reverse = !t.reverse
+	case "/", "~", "i":
+		t.prompt, t.input = rune(key[0]), ""
+	case "\x1b":
+		t.filter, t.regex = "", nil
+	case " ", "p":
+		t.paused = !t.paused
+		if !t.paused {
+			t.sample = t.latest
+		}
+	case "+":
+		t.setInterval(t.currentInterval() + 1)
+	case "-":
+		t.setInterval(t.currentInterval() - 1)
+	case "\x1b[A", "k":
+		t.scroll--
+	case "\x1b[B", "j":
+		t.scroll++
+	case "\x1b[5~":
+		t.scroll -= page
+	case "\x1b[6~":
+		t.scroll += page
+	case "\x1b[H", "\x1b[1~", "\x1bOH", "g":
+		t.scroll = 0
+	case "\x1b[F", "\x1b[4~", "\x1bOF", "G":
+		t.scroll = 1 << 30
+	case "\x1b[D", "h":
+		t.column--
+	case "\x1b[C", "l":
+		t.column++
+	default:
+		// The number keys pick a section, 1 is the first one.
+		if len(key) == 1 && key[0] >= '1' && int(key[0]-'1') < len(tuiSections) {
+			t.section, t.selected, t.scroll, t.sortColumn = int(key[0]-'1'), true, 0, 0
+		}
+	}
+}
@@ -0,0 +1,375 @@
+// lure web dashboard. Polls the JSON interface once per sample interval, keeps the last minutes of samples in
+// the browser and renders sortable tables, sparklines and line charts. No external libraries on purpose.
+'use strict';
+
+const SECTIONS = [
+    {id: 'mdt', title: 'MDT Metadata Stats /s', label: 'Device', jobs: false},
+    {id: 'ost', title: 'OST Operation Stats /s', label: 'Device', jobs: false},
+    {id: 'client', title: 'Client Operation Stats /s', label: 'Filesystem', jobs: false},
+    {id: 'mdtjob', title: 'MDT Jobstats /s', label: 'Job @ Device', jobs: true},
+    {id: 'ostjob', title: 'OST Jobstats /s', label: 'Job @ Device', jobs: true},
+];
+
+const state = {
+    info: null,
+    lastTime: null,
+    paused: false,
+    filter: '',
+    windowMs: 15 * 60 * 1000,
+    job: null,
+    sections: {},
+};
+
+for (const section of SECTIONS) {
+    // rows: latest sample, history: row key -> [{t, v}], totals: [{t, v}] summed over all rows.
+    state.sections[section.id] = {rows: [], history: new Map(), totals: [], sortCounter: null, sortDesc: true,
+        chartCounter: null};
+}
+
+// Same format as go-humanize, which the console output uses.
+function formatBytes(value) {
+    const units = ['B', 'kB', 'MB', 'GB', 'TB', 'PB', 'EB'];
+    if (value < 10) {
+        return value + ' B';
+    }
+    const e = Math.min(Math.floor(Math.log(value) / Math.log(1000)), units.length - 1);
+    const v = value / Math.pow(1000, e);
+    return (v < 10 ? v.toFixed(1) : v.toFixed(0)) + ' ' + units[e];
+}
+
+function formatValue(counter, value) {
+    return counter.includes('bytes') ? formatBytes(value) : value.toLocaleString();
+}
+
+function escapeHTML(text) {
+    return String(text).replace(/[&<>"']/g, c => ({'&': '&amp;', '<': '&lt;', '>': '&gt;', '"': '&quot;',
+        "'": '&#39;'})[c]);
+}
+
+// Short device name as in the console, testfs-OST0000 becomes OST0000 for jobs and testfs for client mounts.
+function shortDevice(section, device) {
+    const parts = device.split('-');
+    if (section.jobs) {
+        return parts.length > 1 ? parts[1] : device;
+    }
+    if (section.id === 'client') {
+        return parts[0];
+    }
+    return device;
+}
+
+// Flattens the JSON maps into rows, jobs are keyed job@device.
+function toRows(section, data) {
+    const rows = [];
+    for (const device of Object.keys(data || {})) {
+        if (section.jobs) {
+            for (const job of Object.keys(data[device])) {
+                rows.push({key: job + '@' + device, name: job + '@' + shortDevice(section, device), job: job,
+                    device: device, counters: data[device][job]});
+            }
+        } else {
+            rows.push({key: device, name: shortDevice(section, device), device: device, counters: data[device]});
+        }
+    }
+    return rows;
+}
+
+function addSample(section, rows, time) {
+    const s = state.sections[section.id];
+    const counters = state.info.counters[section.id] || [];
+    const totals = {};
+    for (const row of rows) {
+        if (!s.history.has(row.key)) {
+            s.history.set(row.key, []);
+        }
+        s.history.get(row.key).push({t: time, v: row.counters});
+        for (const counter of counters) {
+            totals[counter] = (totals[counter] || 0) + (row.counters[counter] || 0);
+        }
+    }
+    s.totals.push({t: time, v: totals});
+    s.rows = rows;
+
+    // Forget everything older than the selected history window.
+    const oldest = time - state.windowMs;
+    for (const [key, points] of s.history) {
+        while (points.length && points[0].t < oldest) {
+            points.shift();
+        }
+        if (!points.length) {
+            s.history.delete(key);
+        }
+    }
+    while (s.totals.length && s.totals[0].t < oldest) {
+        s.totals.shift();
+    }
+}
+
+function drawLine(canvas, points, color, spark) {
+    const ctx = canvas.getContext('2d');
+    const width = canvas.width;
+    const height = canvas.height;
+    const pad = spark ? 1 : 18;
+    ctx.clearRect(0, 0, width, height);
+    if (points.length === 0) {
+        return;
+    }
+
+    const now = points[points.length - 1].t;
+    const start = now - state.windowMs;
+    const max = Math.max(1, ...points.map(p => p.y));
+    const x = t => pad + (width - 2 * pad) * (t - start) / state.windowMs;
+    const y = v => height - pad - (height - 2 * pad) * v / max;
+
+    if (!spark) {
+        ctx.strokeStyle = '#ccc';
+        ctx.beginPath();
+        ctx.moveTo(pad, height - pad);
+        ctx.lineTo(width - pad, height - pad);
+        ctx.moveTo(pad, pad);
+        ctx.lineTo(pad, height - pad);
+        ctx.stroke();
+        ctx.fillStyle = '#555';
+        ctx.font = '11px sans-serif';
+        ctx.fillText(points.label ? points.label(max) : max.toLocaleString(), pad + 4, pad - 4);
+        ctx.fillText(new Date(start).toLocaleTimeString(), pad, height - 4);
+        const end = new Date(now).toLocaleTimeString();
+        ctx.fillText(end, width - pad - ctx.measureText(end).width, height - 4);
+    }
+
+    ctx.strokeStyle = color;
+    ctx.lineWidth = spark ? 1 : 1.5;
+    ctx.beginPath();
+    points.forEach((p, i) => i === 0 ? ctx.moveTo(x(p.t), y(p.y)) : ctx.lineTo(x(p.t), y(p.y)));
+    ctx.stroke();
+}
+
+function chartPoints(history, counter) {
+    const points = history.map(p => ({t: p.t, y: p.v[counter] || 0}));
+    if (counter.includes('bytes')) {
+        points.label = formatBytes;
+    }
+    return points;
+}
+
+function matchesFilter(row) {
+    return state.filter === '' || row.name.toLowerCase().includes(state.filter) ||
+        row.device.toLowerCase().includes(state.filter);
+}
+
+function renderSection(section, container) {
+    const s = state.sections[section.id];
+    const counters = state.info.counters[section.id] || [];
+    if (!s.chartCounter || !counters.includes(s.chartCounter)) {
+        s.chartCounter = counters.find(c => c.includes('bytes')) || counters[0];
+    }
+
+    let element = document.getElementById('section-' + section.id);
+    if (!element) {
+        element = document.createElement('section');
+        element.id = 'section-' + section.id;
+        container.appendChild(element);
+    }
+
+    const rows = s.rows.filter(matchesFilter);
+    if (s.sortCounter) {
+        rows.sort((a, b) => ((a.counters[s.sortCounter] || 0) - (b.counters[s.sortCounter] || 0)) *
+            (s.sortDesc ? -1 : 1));
+    } else {
+        rows.sort((a, b) => a.name.localeCompare(b.name) * (s.sortDesc ? 1 : -1));
+    }
+
+    const options = counters.map(c => `<option${c === s.chartCounter ? ' selected' : ''}>${escapeHTML(c)}</option>`);
+    let html = `<h2>${escapeHTML(section.title)}</h2>
+        <div class="chartrow"><canvas class="chart" width="600" height="120"></canvas>
+        <label>Chart <select class="chart-counter">${options.join('')}</select></label></div>`;
+
+    if (rows.length === 0) {
+        html += `<p class="empty">No ${escapeHTML(section.title.replace(' /s', ''))} available.</p>`;
+    } else {
+        html += '<table><thead><tr>';
+        html += `<th data-counter=""${s.sortCounter ? '' : ' class="sorted"'}>${escapeHTML(section.label)}</th>`;
+        html += `<th title="${escapeHTML(s.chartCounter)} over the last minutes">Trend</th>`;
+        for (const counter of counters) {
+            const arrow = counter === s.sortCounter ? (s.sortDesc ? ' ▼' : ' ▲') : '';
+            html += `<th data-counter="${escapeHTML(counter)}"${arrow ? ' class="sorted"' : ''}>` +
+                `${escapeHTML(counter)}${arrow}</th>`;
+        }
+        html += '</tr></thead><tbody>';
+        rows.forEach((row, i) => {
+            const name = section.jobs ?
+                `<a data-job="${escapeHTML(row.job)}">${escapeHTML(row.job)}</a>@${escapeHTML(shortDevice(section, row.device))}` :
+                escapeHTML(row.name);
+            html += `<tr><td title="${escapeHTML(row.device)}">${name}</td>` +
+                `<td><canvas class="spark" data-row="${i}" width="100" height="20"></canvas></td>`;
+            for (const counter of counters) {
+                html += `<td>${formatValue(counter, row.counters[counter] || 0)}</td>`;
+            }
+            html += '</tr>';
+        });
+        html += '</tbody></table>';
+    }
+    element.innerHTML = html;
+
+    drawLine(element.querySelector('canvas.chart'), chartPoints(s.totals, s.chartCounter), '#1a5fb4', false);
+    element.querySelectorAll('canvas.spark').forEach(canvas => {
+        const row = rows[Number(canvas.dataset.row)];
+        drawLine(canvas, chartPoints(s.history.get(row.key) || [], s.chartCounter), '#2e8b57', true);
+    });
+
+    element.querySelector('select.chart-counter').onchange = event => {
+        s.chartCounter = event.target.value;
+        render();
+    };
+    element.querySelectorAll('th[data-counter]').forEach(th => th.onclick = () => {
+        const counter = th.dataset.counter || null;
+        s.sortDesc = s.sortCounter === counter ? !s.sortDesc : true;
+        s.sortCounter = counter;
+        render();
+    });
+    element.querySelectorAll('a[data-job]').forEach(a => a.onclick = () => {
+        state.job = a.dataset.job;
+        render();
+        window.scrollTo(0, 0);
+    });
+}
+
+// Sums the job over all devices for every sample in the history.
+function jobTotals(sectionId, job, counters) {
+    const byTime = new Map();
+    for (const [key, points] of state.sections[sectionId].history) {
+        if (!key.startsWith(job + '@')) {
+            continue;
+        }
+        for (const p of points) {
+            let sum = byTime.get(p.t) || 0;
+            for (const counter of counters) {
+                sum += p.v[counter] || 0;
+            }
+            byTime.set(p.t, sum);
+        }
+    }
+    return [...byTime.entries()].sort((a, b) => a[0] - b[0]).map(([t, y]) => ({t: t, y: y}));
+}
+
+function renderJob() {
+    const panel = document.getElementById('job');
+    if (!state.job) {
+        panel.hidden = true;
+        return;
+    }
+    panel.hidden = false;
+    document.getElementById('job-title').textContent = 'Job ' + state.job;
+
+    const bytes = jobTotals('ostjob', state.job, ['read_bytes', 'write_bytes']);
+    bytes.label = formatBytes;
+    drawLine(document.getElementById('job-bytes'), bytes, '#1a5fb4', false);
+    const mdtCounters = (state.info.counters.mdtjob || []).filter(c => !c.includes('bytes'));
+    drawLine(document.getElementById('job-ops'), jobTotals('mdtjob', state.job, mdtCounters), '#2e8b57', false);
+
+    let html = '';
+    for (const section of SECTIONS.filter(sec => sec.jobs)) {
+        const rows = state.sections[section.id].rows.filter(row => row.job === state.job);
+        if (rows.length === 0) {
+            continue;
+        }
+        const counters = state.info.counters[section.id] || [];
+        html += `<h3>${escapeHTML(section.title)}</h3><table><thead><tr><th>Device</th>`;
+        html += counters.map(c => `<th>${escapeHTML(c)}</th>`).join('') + '</tr></thead><tbody>';
+        for (const row of rows) {
+            html += `<tr><td>${escapeHTML(row.device)}</td>`;
+            html += counters.map(c => `<td>${formatValue(c, row.counters[c] || 0)}</td>`).join('') + '</tr>';
+        }
+        html += '</tbody></table>';
+    }
+    document.getElementById('job-devices').innerHTML = html || '<p class="empty">The job is not active.</p>';
+}
+
+function visibleSections() {
+    return SECTIONS.filter(section => state.info.client ? section.id === 'client' : section.id !== 'client');
+}
+
+function render() {
+    if (!state.info) {
+        return;
+    }
+    document.getElementById('node').textContent = 'Lustre node: ' + state.info.host;
+    document.getElementById('time').textContent = 'Time: ' + new Date(state.info.time).toLocaleString();
+    document.getElementById('interval').textContent = 'Sample Interval: ' + state.info.interval + 's';
+
+    const container = document.getElementById('sections');
+    for (const section of SECTIONS) {
+        const element = document.getElementById('section-' + section.id);
+        if (element && !visibleSections().includes(section)) {
+            element.remove();
+        }
+    }
+    for (const section of visibleSections()) {
+        renderSection(section, container);
+    }
+    renderJob();
+}
+
+function setStatus(text, error) {
+    const status = document.getElementById('status');
+    status.textContent = text;
+    status.className = error ? 'error' : '';
+}
+
+async function fetchJSON(stats) {
+    const response = await fetch('json?stats=' + stats, {cache: 'no-store'});
+    if (response.status === 204) {
+        return {};
+    }
+    if (!response.ok) {
+        throw new Error(stats + ': HTTP ' + response.status);
+    }
+    return response.json();
+}
+
+async function poll() {
+    let wait = 1000;
+    try {
+        const info = await fetchJSON('info');
+        wait = Math.max(500, info.interval * 500);
+        if (!state.paused && info.time !== state.lastTime) {
+            state.info = info;
+            state.lastTime = info.time;
+            const time = new Date(info.time).getTime() || Date.now();
+            const sections = visibleSections();
+            const results = await Promise.all(sections.map(section => fetchJSON(section.id)));
+            sections.forEach((section, i) => addSample(section, toRows(section, results[i]), time));
+            render();
+        }
+        const down = info.down || [];
+        if (down.length > 0) {
+            setStatus('Agents not answering: ' + down.join(', '), true);
+        } else {
+            setStatus(state.paused ? 'Paused' : '', false);
+        }
+    } catch (error) {
+        setStatus('Connection problem: ' + error.message, true);
+        wait = 5000;
+    }
+    setTimeout(poll, wait);
+}
+
+document.getElementById('pause').onclick = event => {
+    state.paused = !state.paused;
+    event.target.textContent = state.paused ? 'Resume' : 'Pause';
+    setStatus(state.paused ? 'Paused' : '', false);
+};
+document.getElementById('filter').oninput = event => {
+    state.filter = event.target.value.trim().toLowerCase();
+    render();
+};
+document.getElementById('window').onchange = event => {
+    state.windowMs = Number(event.target.value) * 60 * 1000;
+    render();
+};
+document.getElementById('job-close').onclick = () => {
+    state.job = null;
+    render();
+};
+
+poll();